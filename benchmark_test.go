@@ -17,6 +17,7 @@
 package sroar
 
 import (
+	"fmt"
 	"math/rand"
 	"runtime"
 	"testing"
@@ -138,6 +139,58 @@ func BenchmarkMerge10K(b *testing.B) {
 	})
 }
 
+// go test -bench BenchmarkFastParOr -run -
+func BenchmarkFastParOr(b *testing.B) {
+	// Sparse inputs hold a few elements per container, so the unions stay
+	// arrays. Dense inputs hold thousands, so the unions become bitmaps.
+	for _, tc := range []struct {
+		name  string
+		perKB int
+	}{{"sparse", 10}, {"dense", 2000}} {
+		var bitmaps []*Bitmap
+		for i := 0; i < 50; i++ {
+			bm := NewBitmap()
+			for key := uint64(0); key < 200; key++ {
+				for j := 0; j < tc.perKB; j++ {
+					bm.Set(key<<16 | uint64(rand.Intn(1<<16)))
+				}
+			}
+			bitmaps = append(bitmaps, bm)
+		}
+
+		b.Run(tc.name+"/fastor", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = FastOr(bitmaps...)
+			}
+		})
+		for _, numGo := range []int{2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/fastparor-%d", tc.name, numGo), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_ = FastParOr(numGo, bitmaps...)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSetRange(b *testing.B) {
+	N := uint64(1e6)
+	b.Run("set", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bm := NewBitmap()
+			for x := uint64(0); x < N; x++ {
+				bm.Set(x)
+			}
+		}
+	})
+	b.Run("setrange", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bm := NewBitmap()
+			bm.SetRange(0, N)
+		}
+	})
+}
+
 func BenchmarkRemoveRange(b *testing.B) {
 	bm := NewBitmap()
 	N := uint64(1e5)
@@ -233,3 +286,88 @@ func BenchmarkSelectRoaring64(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkSelectRankManyContainers(b *testing.B) {
+	bm := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		bm.Set(uint64(i) << 16)
+	}
+	card := uint64(bm.GetCardinality())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x := uint64(i) % card
+		if _, err := bm.Select(x); err != nil {
+			b.Fatal(err)
+		}
+		bm.Rank(x << 16)
+	}
+}
+
+func BenchmarkBitmapContainer(b *testing.B) {
+	c := make([]uint16, maxContainerSize)
+	c[indexSize] = maxContainerSize
+	c[indexType] = typeBitmap
+	bm := bitmap(c)
+	for i := 0; i < 30000; i++ {
+		bm.add(uint16(rand.Intn(1 << 16)))
+	}
+	all := bm.all()
+
+	b.Run("select", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bm.selectAt(i % len(all))
+		}
+	})
+	b.Run("rank", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bm.rank(all[i%len(all)])
+		}
+	})
+}
+
+func BenchmarkArrayContainer(b *testing.B) {
+	const n = 2000
+	c := make([]uint16, int(startIdx)+n)
+	c[indexSize] = uint16(len(c))
+	c[indexType] = typeArray
+	a := array(c)
+	vals := make([]uint16, 0, n)
+	for getCardinality(c) < n {
+		x := uint16(rand.Intn(1 << 16))
+		if a.add(x) {
+			vals = append(vals, x)
+		}
+	}
+
+	b.Run("find", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			a.find(uint16(i))
+		}
+	})
+	b.Run("has", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			a.has(uint16(i))
+		}
+	})
+	b.Run("rank", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			a.rank(vals[i%n])
+		}
+	})
+	b.Run("remove-add", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			x := vals[i%n]
+			a.remove(x)
+			a.add(x)
+		}
+	})
+	b.Run("add-sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if i%n == 0 {
+				setCardinality(c, 0)
+			}
+			a.add(uint16(i%n) * 32)
+		}
+	})
+}
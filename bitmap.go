@@ -19,9 +19,11 @@ package sroar
 import (
 	"fmt"
 	"math"
+	"math/bits"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -42,56 +44,103 @@ type Bitmap struct {
 	// memMoved keeps track of how many uint16 moves we had to do. The smaller
 	// this number, the more efficient we have been.
 	memMoved int
+
+	// cards is an optional index of the cumulative cardinalities of the
+	// containers, which lets Rank and Select binary search for the container
+	// they need. It's built lazily, and dropped on any modification. It's
+	// accessed atomically, so that the read-only bitmaps shared across
+	// goroutines, like the ones created via FromBuffer, can build it too.
+	cards atomic.Pointer[cardIndex]
+}
+
+// cardIndex holds the number of elements in the containers before each key. Its
+// last entry is the cardinality of the bitmap.
+type cardIndex []int
+
+// cardIndex returns the index of the cumulative cardinalities of the containers,
+// building it if needed.
+func (ra *Bitmap) cardIndex() cardIndex {
+	if ra == nil {
+		return cardIndex{0}
+	}
+	if idx := ra.cards.Load(); idx != nil {
+		return *idx
+	}
+	n := ra.keys.numKeys()
+	idx := make(cardIndex, n+1)
+	for i := 0; i < n; i++ {
+		idx[i+1] = idx[i] + getCardinality(ra.getContainer(ra.keys.val(i)))
+	}
+	ra.cards.Store(&idx)
+	return idx
+}
+
+// modified drops the index of the cardinalities, if any. It must be called by
+// all the operations modifying the bitmap.
+func (ra *Bitmap) modified() {
+	if ra.cards.Load() != nil {
+		ra.cards.Store(nil)
+	}
 }
 
 // FromBuffer returns a pointer to bitmap corresponding to the given buffer. This bitmap shouldn't
-// be modified because it might corrupt the given buffer.
+// be modified because it might corrupt the given buffer. The buffer can be in the legacy or the
+// versioned layout. The checksum of a versioned buffer isn't verified, use FromBufferChecked for
+// that. The buffer is expected in the canonical little-endian byte order. On big-endian hosts, it
+// gets copied to convert it to the host byte order. It panics if a versioned buffer has an unknown
+// version or flags. Use FromBufferChecked to get an error instead.
 func FromBuffer(data []byte) *Bitmap {
+	data, err := bitmapData(data, false)
+	if err != nil {
+		panic(err)
+	}
 	assert(len(data)%2 == 0)
 	if len(data) < 8 {
 		return NewBitmap()
 	}
-	du := toUint16Slice(data)
-	x := toUint64Slice(du[:4])[indexNodeSize]
-	return &Bitmap{
-		data: du,
-		_ptr: data, // Keep a hold of data, otherwise GC would do its thing.
-		keys: toUint64Slice(du[:x]),
-	}
+	return fromData(fromCanonical(data, false), data)
 }
 
 // FromBufferWithCopy creates a copy of the given buffer and returns a bitmap based on the copied
-// buffer. This bitmap is safe for both read and write operations.
+// buffer. This bitmap is safe for both read and write operations. Just like FromBuffer, it panics
+// if a versioned buffer has an unknown version or flags.
 func FromBufferWithCopy(src []byte) *Bitmap {
+	src, err := bitmapData(src, false)
+	if err != nil {
+		panic(err)
+	}
 	assert(len(src)%2 == 0)
 	if len(src) < 8 {
 		return NewBitmap()
 	}
-	src16 := toUint16Slice(src)
-	dst16 := make([]uint16, len(src16))
-	copy(dst16, src16)
-	x := toUint64Slice(dst16[:4])[indexNodeSize]
+	return fromData(fromCanonical(src, true), nil)
+}
 
+// fromData returns a bitmap based on the given data, which is already in the host byte order. ptr
+// is the buffer backing data, if data doesn't own it.
+func fromData(data []uint16, ptr []byte) *Bitmap {
+	x := toUint64Slice(data[:4])[indexNodeSize]
 	return &Bitmap{
-		data: dst16,
-		keys: toUint64Slice(dst16[:x]),
+		data: data,
+		_ptr: ptr, // Keep a hold of data, otherwise GC would do its thing.
+		keys: toUint64Slice(data[:x]),
 	}
 }
 
+// ToBuffer returns the bitmap serialized in the legacy layout, in the canonical little-endian byte
+// order. On little-endian hosts, it doesn't make a copy.
 func (ra *Bitmap) ToBuffer() []byte {
 	if ra.IsEmpty() {
 		return nil
 	}
-	return toByteSlice(ra.data)
+	return toCanonical(ra.data, false)
 }
 
 func (ra *Bitmap) ToBufferWithCopy() []byte {
 	if ra.IsEmpty() {
 		return nil
 	}
-	buf := make([]uint16, len(ra.data))
-	copy(buf, ra.data)
-	return toByteSlice(buf)
+	return toCanonical(ra.data, true)
 }
 
 func NewBitmap() *Bitmap {
@@ -241,8 +290,9 @@ func (ra *Bitmap) expandContainer(offset uint64) {
 	bySize := uint16(sz)
 	if sz >= 2048 {
 		// Size is in uint16. Half of max allowed size. If we're expanding the container by more
-		// than 2048, we should just cap it to max size of 4096.
-		assert(sz < maxContainerSize)
+		// than 2048, we should just cap it to max size of 4096. An array container might already
+		// occupy the max size, if it was converted from a bitmap container in place.
+		assert(sz <= maxContainerSize)
 		bySize = maxContainerSize - sz
 	}
 
@@ -255,8 +305,7 @@ func (ra *Bitmap) expandContainer(offset uint64) {
 
 	} else {
 		// Convert to bitmap container.
-		src := array(ra.getContainer(offset))
-		buf := src.toBitmapContainer(nil)
+		buf := containerToBitmap(ra.getContainer(offset), nil)
 		assert(copy(ra.data[offset:], buf) == maxContainerSize)
 	}
 }
@@ -281,7 +330,7 @@ func stepSize(n uint16) uint16 {
 
 // copyAt would copy over a given container via src, into the container at
 // offset. If src is a bitmap, it would copy it over directly. If src is an
-// array container, then it would follow these paths:
+// array or a run container, then it would follow these paths:
 // - If src is smaller than dst, copy it over.
 // - If not, look for target size for dst using the stepSize function.
 // - If target size is maxSize, then convert src to a bitmap container, and
@@ -304,7 +353,7 @@ func (ra *Bitmap) copyAt(offset uint64, src []uint16) {
 		return
 	}
 
-	// src is an array container. Check if dstSize >= src. If so, just copy.
+	// src is an array or a run container. Check if dstSize >= src. If so, just copy.
 	// But, do keep dstSize intact, otherwise we'd lose portion of our container.
 	if dstSize >= src[indexSize] {
 		assert(copy(ra.data[offset:], src) == len(src))
@@ -320,8 +369,6 @@ func (ra *Bitmap) copyAt(offset uint64, src []uint16) {
 
 	if targetSz == maxContainerSize {
 		// Looks like the targetSize is now maxSize. So, convert src to bitmap container.
-		s := array(src)
-
 		bySize := uint16(maxContainerSize) - dstSize
 		// Select the portion to the right of the container, beyond its right boundary.
 		ra.scootRight(offset+uint64(dstSize), uint64(bySize))
@@ -330,14 +377,14 @@ func (ra *Bitmap) copyAt(offset uint64, src []uint16) {
 		// Update the space of the container, so getContainer would work correctly.
 		ra.data[offset] = maxContainerSize
 
-		// Convert the src array to bitmap and write it directly over to the container.
+		// Convert the src to bitmap and write it directly over to the container.
 		out := ra.getContainer(offset)
 		Memclr(out)
-		s.toBitmapContainer(out)
+		containerToBitmap(src, out)
 		return
 	}
 
-	// targetSize is not maxSize. Let's expand to targetSize and copy array.
+	// targetSize is not maxSize. Let's expand to targetSize and copy src.
 	bySize := targetSz - dstSize
 	ra.scootRight(offset+uint64(dstSize), uint64(bySize))
 	ra.keys.updateOffsets(offset, uint64(bySize), true)
@@ -345,7 +392,7 @@ func (ra *Bitmap) copyAt(offset uint64, src []uint16) {
 	ra.data[offset] = targetSz
 }
 
-func (ra Bitmap) getContainer(offset uint64) []uint16 {
+func (ra *Bitmap) getContainer(offset uint64) []uint16 {
 	data := ra.data[offset:]
 	if len(data) == 0 {
 		panic(fmt.Sprintf("No container found at offset: %d\n", offset))
@@ -377,6 +424,7 @@ func (ra *Bitmap) IsEmpty() bool {
 }
 
 func (ra *Bitmap) Set(x uint64) bool {
+	ra.modified()
 	key := x & mask
 	offset, has := ra.keys.getValue(key)
 	if !has {
@@ -392,13 +440,21 @@ func (ra *Bitmap) Set(x uint64) bool {
 		if added := p.add(uint16(x)); !added {
 			return false
 		}
-		if p.isFull() {
+		if p.isFull() && !p.runOptimize() {
 			ra.expandContainer(offset)
 		}
 		return true
 	case typeBitmap:
 		b := bitmap(c)
 		return b.add(uint16(x))
+	case typeRun:
+		r := run(c)
+		if r.isFull() && !r.has(uint16(x)) {
+			// x might need a new run. Expand the container to make space for it.
+			ra.expandContainer(offset)
+			return ra.Set(x)
+		}
+		return r.add(uint16(x))
 	}
 	panic("we shouldn't reach here")
 }
@@ -428,10 +484,26 @@ func FromSortedList(vals []uint64) *Bitmap {
 		if len(l) == 0 {
 			return
 		}
+		sz := uint16(maxContainerSize)
 		if len(l) <= 2048 {
 			// 4 uint16s for the header, and extra 4 uint16s so that adding more elements using
 			// Set operation doesn't fail.
-			sz := uint16(8 + len(l))
+			sz = uint16(8 + len(l))
+		}
+		if n := numRuns(l); runSize(n) < int(sz) {
+			// Run container is smaller than the array or bitmap container.
+			off = ra.newContainer(uint16(runSize(n)))
+			c := ra.getContainer(off)
+			c[indexType] = typeRun
+			r := run(c)
+			var m int
+			for _, v := range l {
+				m = appendRun(r[runOffset(0):], m, v, v)
+			}
+			r.setNumRuns(m)
+			setCardinality(c, len(l))
+
+		} else if len(l) <= 2048 {
 			off = ra.newContainer(sz)
 			c := ra.getContainer(off)
 			c[indexSize] = sz
@@ -478,28 +550,16 @@ func (ra *Bitmap) SetMany(vals []uint64) {
 
 // Select returns the element at the xth index. (0-indexed)
 func (ra *Bitmap) Select(x uint64) (uint64, error) {
-	if x >= uint64(ra.GetCardinality()) {
-		return 0, errors.Errorf("index %d is not less than the cardinality: %d",
-			x, ra.GetCardinality())
-	}
-	n := ra.keys.numKeys()
-	for i := 0; i < n; i++ {
-		off := ra.keys.val(i)
-		con := ra.getContainer(off)
-		c := uint64(getCardinality(con))
-		assert(c != uint64(invalidCardinality))
-		if x < c {
-			key := ra.keys.key(i)
-			switch con[indexType] {
-			case typeArray:
-				return key | uint64(array(con).all()[x]), nil
-			case typeBitmap:
-				return key | uint64(bitmap(con).selectAt(int(x))), nil
-			}
-		}
-		x -= c
-	}
-	panic("should not reach here")
+	idx := ra.cardIndex()
+	n := len(idx) - 1
+	if x >= uint64(idx[n]) {
+		return 0, errors.Errorf("index %d is not less than the cardinality: %d", x, idx[n])
+	}
+	// Find the container holding the xth element, i.e. the first one whose
+	// elements take the count past x.
+	i := sort.Search(n, func(i int) bool { return uint64(idx[i+1]) > x })
+	con := ra.getContainer(ra.keys.val(i))
+	return ra.keys.key(i) | uint64(containerSelect(con, int(x)-idx[i])), nil
 }
 
 func (ra *Bitmap) Contains(x uint64) bool {
@@ -511,24 +571,14 @@ func (ra *Bitmap) Contains(x uint64) bool {
 	if !has {
 		return false
 	}
-	y := uint16(x)
-
-	c := ra.getContainer(offset)
-	switch c[indexType] {
-	case typeArray:
-		p := array(c)
-		return p.has(y)
-	case typeBitmap:
-		b := bitmap(c)
-		return b.has(y)
-	}
-	return false
+	return containerHas(ra.getContainer(offset), uint16(x))
 }
 
 func (ra *Bitmap) Remove(x uint64) bool {
 	if ra == nil {
 		return false
 	}
+	ra.modified()
 	key := x & mask
 	offset, has := ra.keys.getValue(key)
 	if !has {
@@ -542,6 +592,14 @@ func (ra *Bitmap) Remove(x uint64) bool {
 	case typeBitmap:
 		b := bitmap(c)
 		return b.remove(uint16(x))
+	case typeRun:
+		r := run(c)
+		if r.isFull() && r.has(uint16(x)) {
+			// Removing x from the middle of a run splits it. Expand the container to make space.
+			ra.expandContainer(offset)
+			return ra.Remove(x)
+		}
+		return r.remove(uint16(x))
 	}
 	return true
 }
@@ -558,13 +616,13 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 	k1 := lo & mask
 	k2 := hi & mask
 
+	ra.modified()
 	defer ra.Cleanup()
 
 	//  Complete range lie in a single container
 	if k1 == k2 {
 		if off, has := ra.keys.getValue(k1); has {
-			c := ra.getContainer(off)
-			removeRangeContainer(c, uint16(lo), uint16(hi)-1)
+			ra.removeRangeAt(off, uint16(lo), uint16(hi)-1)
 		}
 		return
 	}
@@ -593,7 +651,7 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 		if uint16(lo) == 0 {
 			zeroOutContainer(c)
 		} else {
-			removeRangeContainer(c, uint16(lo), math.MaxUint16)
+			ra.removeRangeAt(off, uint16(lo), math.MaxUint16)
 		}
 	}
 
@@ -603,12 +661,160 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 
 	// Remove all elements < hi in k2's container
 	if off, has := ra.keys.getValue(k2); has {
-		c := ra.getContainer(off)
-		removeRangeContainer(c, 0, uint16(hi)-1)
+		ra.removeRangeAt(off, 0, uint16(hi)-1)
 	}
 }
 
+// SetRange sets all the elements in [lo, hi) in the bitmap. Each container is filled in one pass.
+// The containers fully covered by the range are created as a single run, instead of as full bitmap
+// containers. A run holds the same elements in a few uint16s instead of 4096 words, and the run
+// containers are handled everywhere the bitmap containers are.
+func (ra *Bitmap) SetRange(lo, hi uint64) {
+	if lo > hi {
+		panic("lo should not be more than hi")
+	}
+	if lo == hi {
+		return
+	}
+	ra.modified()
+
+	buf := make([]uint16, maxContainerSize)
+	rangeContainers(lo, hi, func(key uint64, start, last uint16) {
+		ra.setRangeAt(key, start, last, buf)
+	})
+}
+
+// setRangeAt sets [lo, hi] in the container for the given key. Whole ranges are represented by a
+// single run. So, a fully covered container costs only a few uint16s.
+func (ra *Bitmap) setRangeAt(key uint64, lo, hi uint16, buf []uint16) {
+	rc := rangeContainer(lo, hi)
+	offset, has := ra.keys.getValue(key)
+	if !has {
+		// We need to add a container.
+		o := ra.newContainer(uint16(len(rc)))
+		copy(ra.getContainer(o), rc)
+		ra.setKey(key, o)
+		return
+	}
+	if c := containerOr(ra.getContainer(offset), rc, buf, runInline); len(c) > 0 {
+		ra.copyAt(offset, c)
+	}
+}
+
+// Flip inverts the membership of all the elements in [lo, hi) in the bitmap. Elements present in
+// the range are removed, and elements absent from it are added.
+func (ra *Bitmap) Flip(lo, hi uint64) {
+	if lo > hi {
+		panic("lo should not be more than hi")
+	}
+	if lo == hi {
+		return
+	}
+	ra.modified()
+	defer ra.Cleanup()
+
+	buf := make([]uint16, maxContainerSize)
+	rangeContainers(lo, hi, func(key uint64, start, last uint16) {
+		ra.flipAt(key, start, last, buf)
+	})
+}
+
+// flipAt inverts the membership of [lo, hi] in the container for the given key.
+func (ra *Bitmap) flipAt(key uint64, lo, hi uint16, buf []uint16) {
+	offset, has := ra.keys.getValue(key)
+	if !has {
+		// Nothing is present in the container. So, the whole range gets added.
+		rc := rangeContainer(lo, hi)
+		o := ra.newContainer(uint16(len(rc)))
+		copy(ra.getContainer(o), rc)
+		ra.setKey(key, o)
+		return
+	}
+	if c := flipContainer(ra.getContainer(offset), lo, hi, buf, runInline); len(c) > 0 {
+		ra.copyAt(offset, c)
+	}
+}
+
+// Flip returns a new bitmap, which has the membership of all the elements in [lo, hi) of bm
+// inverted. It doesn't modify bm.
+func Flip(bm *Bitmap, lo, hi uint64) *Bitmap {
+	if lo > hi {
+		panic("lo should not be more than hi")
+	}
+	if lo == hi {
+		return bm.Clone()
+	}
+
+	res := NewBitmap()
+	add := func(key uint64, c []uint16) {
+		if getCardinality(c) == 0 {
+			return
+		}
+		off := res.newContainer(uint16(len(c)))
+		copy(res.getContainer(off), c)
+		res.setKey(key, off)
+	}
+
+	k1 := lo & mask
+	n := bm.keys.numKeys()
+
+	// Copy over the containers before the range as they are.
+	i := 0
+	for ; i < n && bm.keys.key(i) < k1; i++ {
+		add(bm.keys.key(i), bm.getContainer(bm.keys.val(i)))
+	}
+
+	buf := make([]uint16, maxContainerSize)
+	rangeContainers(lo, hi, func(key uint64, start, last uint16) {
+		if i < n && bm.keys.key(i) == key {
+			add(key, flipContainer(bm.getContainer(bm.keys.val(i)), start, last, buf, 0))
+			i++
+			return
+		}
+		add(key, rangeContainer(start, last))
+	})
+
+	// And the ones after the range.
+	for ; i < n; i++ {
+		add(bm.keys.key(i), bm.getContainer(bm.keys.val(i)))
+	}
+	return res
+}
+
+// rangeContainers calls fn for the key of every container spanned by [lo, hi), along with the
+// portion of the range [start, last] falling within that container. lo must be less than hi.
+func rangeContainers(lo, hi uint64, fn func(key uint64, start, last uint16)) {
+	// Work with the inclusive range [lo, hi-1], so the key of the last container doesn't overflow
+	// uint64 when hi is close to math.MaxUint64.
+	k1 := lo & mask
+	k2 := (hi - 1) & mask
+
+	for key := k1; ; key += 1 << 16 {
+		start, last := uint16(0), uint16(math.MaxUint16)
+		if key == k1 {
+			start = uint16(lo)
+		}
+		if key == k2 {
+			last = uint16(hi - 1)
+		}
+		fn(key, start, last)
+		if key == k2 {
+			break
+		}
+	}
+}
+
+// removeRangeAt removes [lo, hi] from the container at the given offset.
+func (ra *Bitmap) removeRangeAt(offset uint64, lo, hi uint16) {
+	if c := ra.getContainer(offset); c[indexType] == typeRun && run(c).isFull() {
+		// Removing a range from the middle of a run splits it. Expand the container to make space.
+		ra.expandContainer(offset)
+	}
+	removeRangeContainer(ra.getContainer(offset), lo, hi)
+}
+
 func (ra *Bitmap) Reset() {
+	ra.modified()
 	// reset ra.data to size enough for one container and corresponding key.
 	// 2 u64 is needed for header and another 2 u16 for the key 0.
 	ra.data = ra.data[:16+minContainerSize]
@@ -619,10 +825,17 @@ func (ra *Bitmap) Reset() {
 	ra.keys.setNumKeys(1)
 }
 
+// GetCardinality returns the number of elements in the bitmap. It's read off the index of the
+// cumulative cardinalities, if one was built by Rank or Select. Otherwise, the containers are
+// summed up, without building the index, so that modifying the bitmap in between calls doesn't
+// allocate.
 func (ra *Bitmap) GetCardinality() int {
 	if ra == nil {
 		return 0
 	}
+	if idx := ra.cards.Load(); idx != nil {
+		return (*idx)[len(*idx)-1]
+	}
 	N := ra.keys.numKeys()
 	var sz int
 	for i := 0; i < N; i++ {
@@ -656,40 +869,75 @@ func (ra *Bitmap) ToArray() []uint64 {
 			for _, x := range out {
 				res = append(res, key|uint64(x))
 			}
+		case typeRun:
+			r := run(c)
+			for i := 0; i < r.numRuns(); i++ {
+				for x := uint64(r.start(i)); x <= uint64(r.last(i)); x++ {
+					res = append(res, key|x)
+				}
+			}
 		}
 	}
 	return res
 }
 
+// ToArrayRange returns the elements of the bitmap in [lo, hi), in sorted order.
+func (ra *Bitmap) ToArrayRange(lo, hi uint64) []uint64 {
+	if ra == nil {
+		return nil
+	}
+	itr := ManyItr{it: ra.NewIteratorRange(lo, hi)}
+	res := make([]uint64, 0, 64)
+	for {
+		if len(res) == cap(res) {
+			res = append(res, 0)[:len(res)]
+		}
+		// Decode straight into the spare capacity of res.
+		n := itr.NextMany(res[len(res):cap(res)])
+		if n == 0 {
+			return res
+		}
+		res = res[:len(res)+n]
+	}
+}
+
 func (ra *Bitmap) String() string {
 	var b strings.Builder
 	b.WriteRune('\n')
 
-	var usedSize, card int
-	usedSize += 4 * (ra.keys.numKeys())
 	for i := 0; i < ra.keys.numKeys(); i++ {
 		k := ra.keys.key(i)
 		v := ra.keys.val(i)
 		c := ra.getContainer(v)
-
 		sz := c[indexSize]
-		usedSize += int(sz)
-		card += getCardinality(c)
 
 		b.WriteString(fmt.Sprintf(
 			"[%03d] Key: %#8x. Offset: %7d. Size: %4d. Type: %d. Card: %6d. Uint16/Uid: %.2f\n",
 			i, k, v, sz, c[indexType], getCardinality(c), float64(sz)/float64(getCardinality(c))))
 	}
-	b.WriteString(fmt.Sprintf("Number of containers: %d. Cardinality: %d\n",
-		ra.keys.numKeys(), card))
 
-	amp := float64(len(ra.data)-usedSize) / float64(usedSize)
+	s := ra.Stats()
+	b.WriteString(fmt.Sprintf("Number of containers: %d. Cardinality: %d\n",
+		s.NumKeys, s.Cardinality))
+	for _, ct := range []struct {
+		name string
+		cs   ContainerStats
+	}{{"Arrays", s.Arrays}, {"Bitmaps", s.Bitmaps}, {"Runs", s.Runs}} {
+		b.WriteString(fmt.Sprintf("%s: %d. Bytes: %d. Card: %d\n",
+			ct.name, ct.cs.Count, ct.cs.Bytes, ct.cs.Cardinality))
+	}
+	b.WriteString(fmt.Sprintf("Keys: %d/%d. Node bytes used: %d/%d. Fill histogram: %v\n",
+		s.NumKeys, s.KeyCapacity, s.NodeUsedBytes, s.NodeBytes, s.FillHistogram))
+
+	used := s.UsedBytes()
+	amp := float64(s.TotalBytes-used) / float64(used)
 	b.WriteString(fmt.Sprintf(
-		"Size in Uint16s. Used: %d. Total: %d. Space Amplification: %.2f%%. Moved: %.2fx\n",
-		usedSize, len(ra.data), amp*100.0, float64(ra.memMoved)/float64(usedSize)))
+		"Size in bytes. Used: %d. Orphaned: %d. Total: %d. Space Amplification: %.2f%%. "+
+			"Moved: %.2fx\n",
+		used, s.OrphanedBytes, s.TotalBytes, amp*100.0, float64(s.MemMoved)/float64(used)))
 
-	b.WriteString(fmt.Sprintf("Used Uint16/Uid: %.2f. Total Uint16/Uid: %.2f",
-		float64(usedSize)/float64(card), float64(len(ra.data))/float64(card)))
+	b.WriteString(fmt.Sprintf("Used Bytes/Uid: %.2f. Total Bytes/Uid: %.2f",
+		float64(used)/float64(s.Cardinality), float64(s.TotalBytes)/float64(s.Cardinality)))
 
 	return b.String()
 }
@@ -765,12 +1013,19 @@ func (ra *Bitmap) extreme(dir int) uint64 {
 			return k | uint64(b.minimum())
 		}
 		return k | uint64(b.maximum())
+	case typeRun:
+		r := run(c)
+		if dir == fwd {
+			return k | uint64(r.minimum())
+		}
+		return k | uint64(r.maximum())
 	default:
 		panic("We don't support this type of container")
 	}
 }
 
 func (ra *Bitmap) And(bm *Bitmap) {
+	ra.modified()
 	if bm == nil {
 		ra.Reset()
 		return
@@ -822,7 +1077,7 @@ func And(a, b *Bitmap) *Bitmap {
 	res := NewBitmap()
 	for ai < an && bi < bn {
 		ak := a.keys.key(ai)
-		bk := a.keys.key(bi)
+		bk := b.keys.key(bi)
 		if ak == bk {
 			// Do the intersection.
 			off := a.keys.val(ai)
@@ -852,6 +1107,7 @@ func (ra *Bitmap) AndNot(bm *Bitmap) {
 	if bm == nil {
 		return
 	}
+	ra.modified()
 	a, b := ra, bm
 	var ai, bi int
 
@@ -894,6 +1150,7 @@ func (dst *Bitmap) Or(src *Bitmap) {
 }
 
 func (dst *Bitmap) or(src *Bitmap, runMode int) {
+	dst.modified()
 	srcIdx, numKeys := 0, src.keys.numKeys()
 
 	buf := make([]uint16, maxContainerSize)
@@ -977,6 +1234,251 @@ func Or(a, b *Bitmap) *Bitmap {
 	return res
 }
 
+// Xor computes the symmetric difference of dst and src in place. dst would contain the elements
+// which are present in exactly one of the two bitmaps.
+func (dst *Bitmap) Xor(src *Bitmap) {
+	if src == nil {
+		return
+	}
+	dst.xor(src, runInline)
+	dst.Cleanup()
+}
+
+func (dst *Bitmap) xor(src *Bitmap, runMode int) {
+	dst.modified()
+	srcIdx, numKeys := 0, src.keys.numKeys()
+
+	buf := make([]uint16, maxContainerSize)
+	for ; srcIdx < numKeys; srcIdx++ {
+		srcCont := src.getContainer(src.keys.val(srcIdx))
+		if getCardinality(srcCont) == 0 {
+			continue
+		}
+
+		key := src.keys.key(srcIdx)
+
+		dstIdx := dst.keys.search(key)
+		if dstIdx >= dst.keys.numKeys() || dst.keys.key(dstIdx) != key {
+			// srcCont doesn't exist in dst. So, copy it over.
+			offset := dst.newContainer(uint16(len(srcCont)))
+			copy(dst.getContainer(offset), srcCont)
+			dst.setKey(key, offset)
+		} else {
+			// Container exists in dst as well. Do an inline containerXor.
+			offset := dst.keys.val(dstIdx)
+			dstCont := dst.getContainer(offset)
+			if c := containerXor(dstCont, srcCont, buf, runMode|runInline); len(c) > 0 {
+				dst.copyAt(offset, c)
+				dst.setKey(key, offset)
+			}
+		}
+	}
+}
+
+// Xor returns a new Bitmap holding the elements which are present in exactly one of a and b.
+func Xor(a, b *Bitmap) *Bitmap {
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+
+	buf := make([]uint16, maxContainerSize)
+	res := NewBitmap()
+	for ai < an && bi < bn {
+		ak := a.keys.key(ai)
+		ac := a.getContainer(a.keys.val(ai))
+
+		bk := b.keys.key(bi)
+		bc := b.getContainer(b.keys.val(bi))
+
+		if ak == bk {
+			// Do the symmetric difference.
+			outc := containerXor(ac, bc, buf, 0)
+			if getCardinality(outc) > 0 {
+				offset := res.newContainer(uint16(len(outc)))
+				copy(res.data[offset:], outc)
+				res.setKey(ak, offset)
+			}
+			ai++
+			bi++
+		} else if ak < bk {
+			off := res.newContainer(uint16(len(ac)))
+			copy(res.getContainer(off), ac)
+			res.setKey(ak, off)
+			ai++
+		} else {
+			off := res.newContainer(uint16(len(bc)))
+			copy(res.getContainer(off), bc)
+			res.setKey(bk, off)
+			bi++
+		}
+	}
+	for ai < an {
+		ak := a.keys.key(ai)
+		ac := a.getContainer(a.keys.val(ai))
+		off := res.newContainer(uint16(len(ac)))
+
+		copy(res.getContainer(off), ac)
+		res.setKey(ak, off)
+		ai++
+	}
+	for bi < bn {
+		bk := b.keys.key(bi)
+		bc := b.getContainer(b.keys.val(bi))
+		off := res.newContainer(uint16(len(bc)))
+
+		copy(res.getContainer(off), bc)
+		res.setKey(bk, off)
+		bi++
+	}
+	return res
+}
+
+// AndCardinality returns the number of elements present in both a and b. Unlike And, it doesn't
+// materialize the result, so it doesn't allocate.
+func AndCardinality(a, b *Bitmap) int {
+	if a == nil || b == nil {
+		return 0
+	}
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+
+	var card int
+	for ai < an && bi < bn {
+		ak := a.keys.key(ai)
+		bk := b.keys.key(bi)
+		if ak == bk {
+			ac := a.getContainer(a.keys.val(ai))
+			bc := b.getContainer(b.keys.val(bi))
+			card += containerAndCardinality(ac, bc)
+			ai++
+			bi++
+		} else if ak < bk {
+			ai++
+		} else {
+			bi++
+		}
+	}
+	return card
+}
+
+// OrCardinality returns the number of elements present in either a or b, without materializing the
+// result.
+func OrCardinality(a, b *Bitmap) int {
+	return a.GetCardinality() + b.GetCardinality() - AndCardinality(a, b)
+}
+
+// AndNotCardinality returns the number of elements present in a, but not in b, without
+// materializing the result.
+func AndNotCardinality(a, b *Bitmap) int {
+	return a.GetCardinality() - AndCardinality(a, b)
+}
+
+// XorCardinality returns the number of elements present in exactly one of a and b, without
+// materializing the result.
+func XorCardinality(a, b *Bitmap) int {
+	return a.GetCardinality() + b.GetCardinality() - 2*AndCardinality(a, b)
+}
+
+// Intersects returns true if a and b have at least one element in common.
+func Intersects(a, b *Bitmap) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+
+	for ai < an && bi < bn {
+		ak := a.keys.key(ai)
+		bk := b.keys.key(bi)
+		if ak == bk {
+			ac := a.getContainer(a.keys.val(ai))
+			bc := b.getContainer(b.keys.val(bi))
+			if containerIntersects(ac, bc) {
+				return true
+			}
+			ai++
+			bi++
+		} else if ak < bk {
+			ai++
+		} else {
+			bi++
+		}
+	}
+	return false
+}
+
+// Equals returns true if a and b hold the same elements. The comparison is independent of how the
+// bitmaps are laid out, i.e. container types and sizes, or empty containers don't matter.
+func Equals(a, b *Bitmap) bool {
+	if a == nil || b == nil {
+		return a.IsEmpty() && b.IsEmpty()
+	}
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+
+	for {
+		// Skip over the empty containers, as they don't hold any elements.
+		for ai < an && getCardinality(a.getContainer(a.keys.val(ai))) == 0 {
+			ai++
+		}
+		for bi < bn && getCardinality(b.getContainer(b.keys.val(bi))) == 0 {
+			bi++
+		}
+		if ai == an || bi == bn {
+			return ai == an && bi == bn
+		}
+		if a.keys.key(ai) != b.keys.key(bi) {
+			return false
+		}
+		ac := a.getContainer(a.keys.val(ai))
+		bc := b.getContainer(b.keys.val(bi))
+		if !containerEquals(ac, bc) {
+			return false
+		}
+		ai++
+		bi++
+	}
+}
+
+// IsSubsetOf returns true if all the elements in the bitmap are also present in other.
+func (ra *Bitmap) IsSubsetOf(other *Bitmap) bool {
+	if ra.IsEmpty() {
+		return true
+	}
+	if other == nil {
+		return false
+	}
+	bi, bn := 0, other.keys.numKeys()
+	for ai := 0; ai < ra.keys.numKeys(); ai++ {
+		ac := ra.getContainer(ra.keys.val(ai))
+		card := getCardinality(ac)
+		if card == 0 {
+			continue
+		}
+		key := ra.keys.key(ai)
+		for bi < bn && other.keys.key(bi) < key {
+			bi++
+		}
+		if bi == bn || other.keys.key(bi) != key {
+			return false
+		}
+		if containerAndCardinality(ac, other.getContainer(other.keys.val(bi))) != card {
+			return false
+		}
+	}
+	return true
+}
+
+// Jaccard returns the Jaccard index of a and b, i.e. the size of their intersection divided by the
+// size of their union. Two empty bitmaps are considered equal, and have a Jaccard index of 1.
+func Jaccard(a, b *Bitmap) float64 {
+	and := AndCardinality(a, b)
+	or := a.GetCardinality() + b.GetCardinality() - and
+	if or == 0 {
+		return 1
+	}
+	return float64(and) / float64(or)
+}
+
 func (ra *Bitmap) Rank(x uint64) int {
 	key := x & mask
 	offset, has := ra.keys.getValue(key)
@@ -993,24 +1495,63 @@ func (ra *Bitmap) Rank(x uint64) int {
 		rank = array(c).rank(y)
 	case typeBitmap:
 		rank = bitmap(c).rank(y)
+	case typeRun:
+		rank = run(c).rank(y)
 	}
 	if rank < 0 {
 		return -1
 	}
 
 	// Add up cardinalities of all the containers on the left of container containing x.
-	n := ra.keys.numKeys()
-	for i := 0; i < n; i++ {
-		if ra.keys.key(i) == key {
-			break
+	return ra.cardIndex()[ra.keys.search(key)] + rank
+}
+
+// Compact rewrites the bitmap into a new buffer of minimal size. Empty
+// containers are dropped, except for the one at key 0. The other containers are
+// laid out in the order of their keys, each converted to the type of container
+// taking up the least space. So, bitmaps with the same elements always compact
+// to the same buffer. The node of keys leaves space for just one more key, as
+// adding a key requires it. A bitmap created via FromBuffer can be modified
+// after being compacted, because it no longer uses the given buffer.
+func (ra *Bitmap) Compact() {
+	ra.modified()
+	var n, sz int
+	for i := 0; i < ra.keys.numKeys(); i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		if i == 0 || getCardinality(c) > 0 {
+			csz, _ := minimalSize(c)
+			sz += csz
+			n++
 		}
-		cont := ra.getContainer(ra.keys.val(i))
-		rank += getCardinality(cont)
 	}
-	return rank
+
+	nodeSize := 4 * keyOffset(n+1) // U64 -> U16
+	data := make([]uint16, nodeSize+sz)
+	keys := node(toUint64Slice(data[:nodeSize]))
+	keys.setNodeSize(nodeSize)
+	keys.setNumKeys(n)
+
+	offset, idx := nodeSize, 0
+	for i := 0; i < ra.keys.numKeys(); i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		if i > 0 && getCardinality(c) == 0 {
+			continue
+		}
+		out := minimalContainer(c, data[offset:])
+		keys.setAt(keyOffset(idx), ra.keys.key(i))
+		keys.setAt(valOffset(idx), uint64(offset))
+		offset += len(out)
+		idx++
+	}
+	assert(offset == len(data))
+
+	ra.data = data
+	ra.keys = keys
+	ra._ptr = nil
 }
 
 func (ra *Bitmap) Cleanup() {
+	ra.modified()
 	type interval struct {
 		start uint64
 		end   uint64
@@ -1084,49 +1625,247 @@ func (ra *Bitmap) Cleanup() {
 	}
 }
 
+// FastAnd returns the intersection of the given Bitmaps, without modifying any
+// of them. The bitmaps are intersected in the order of their cardinalities,
+// smallest first, so the intermediate results stay as small as possible.
 func FastAnd(bitmaps ...*Bitmap) *Bitmap {
+	return FastParAnd(1, bitmaps...)
+}
+
+// FastParAnd is the same as FastAnd, but it splits the work across numGo
+// goroutines. Only the keys of the smallest bitmap can be part of the
+// intersection. So, they're split into disjoint ranges, and each goroutine
+// intersects the containers for its range of keys. Unlike FastParOr, this
+// works at a container level, because intersections never expand containers.
+func FastParAnd(numGo int, bitmaps ...*Bitmap) *Bitmap {
 	if len(bitmaps) == 0 {
 		return NewBitmap()
 	}
-	b := bitmaps[0]
-	for _, bm := range bitmaps[1:] {
-		b.And(bm)
+
+	// Order the bitmaps by their cardinalities, without modifying the
+	// caller's slice.
+	sorted := make([]*Bitmap, len(bitmaps))
+	copy(sorted, bitmaps)
+	cards := make(map[*Bitmap]int, len(sorted))
+	for _, b := range sorted {
+		cards[b] = b.GetCardinality()
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return cards[sorted[i]] < cards[sorted[j]]
+	})
+	if cards[sorted[0]] == 0 {
+		return NewBitmap()
+	}
+	if len(sorted) == 1 {
+		return sorted[0].Clone()
+	}
+
+	small := sorted[0]
+	n := small.keys.numKeys()
+	conts := make([][]uint16, n)
+	process := func(start, end int) {
+		for i := start; i < end; i++ {
+			conts[i] = andContainers(small.keys.key(i), sorted)
+		}
+	}
+
+	numGo = max(1, min(numGo, n))
+	if numGo == 1 {
+		process(0, n)
+	} else {
+		width := (n + numGo - 1) / numGo
+		var wg sync.WaitGroup
+		for start := 0; start < n; start += width {
+			end := min(start+width, n)
+			wg.Add(1)
+			go func(start, end int) {
+				defer wg.Done()
+				process(start, end)
+			}(start, end)
+		}
+		wg.Wait()
+	}
+
+	res := NewBitmap()
+	for i, c := range conts {
+		if len(c) == 0 {
+			continue
+		}
+		offset := res.newContainer(uint16(len(c)))
+		copy(res.getContainer(offset), c)
+		res.setKey(small.keys.key(i), offset)
+	}
+	return res
+}
+
+// andContainers intersects the containers for the given key across all the
+// bitmaps. It returns nil if the intersection is empty.
+func andContainers(key uint64, bitmaps []*Bitmap) []uint16 {
+	var res []uint16
+	for i, b := range bitmaps {
+		offset, has := b.keys.getValue(key)
+		if !has {
+			return nil
+		}
+		c := b.getContainer(offset)
+		if i == 0 {
+			res = c
+		} else {
+			res = containerAnd(res, c)
+		}
+		if getCardinality(res) == 0 {
+			return nil
+		}
 	}
-	b.Cleanup()
-	return b
+	return res
 }
 
-// FastParOr would group up bitmaps and call FastOr on them concurrently. It
-// would then merge the groups into final Bitmap. This approach is simpler and
-// faster than operating at a container level, because we can't operate on array
-// containers belonging to the same Bitmap concurrently because array containers
-// can expand, leaving no clear boundaries.
+// FastParOr would merge given Bitmaps into one Bitmap, using numGo goroutines.
+// Just like FastOr, it pre-generates the destination Bitmap based on the
+// container distribution across the bitmaps. Each container in the destination
+// is sized upfront to hold the union of the corresponding containers. So,
+// containers never need to expand, and never move around. That allows
+// splitting the destination into disjoint ranges of container keys, which are
+// then processed concurrently, using about as much memory as FastOr.
 //
 // If FastParOr is called with numGo=1, it just calls FastOr.
-//
-// Experiments with numGo=4 shows that FastParOr would be 2x the speed of
-// FastOr, but 4x the memory usage, even under 50% CPU usage. So, use wisely.
 func FastParOr(numGo int, bitmaps ...*Bitmap) *Bitmap {
-	if numGo == 1 {
+	if numGo <= 1 {
 		return FastOr(bitmaps...)
 	}
-	width := max(len(bitmaps)/numGo, 3)
+	if len(bitmaps) == 0 {
+		return NewBitmap()
+	}
+	if len(bitmaps) == 1 {
+		return bitmaps[0]
+	}
+
+	containers, _ := keyDistribution(bitmaps)
+	dst := newPresizedBitmap(containers)
 
+	// Split the keys into ranges with roughly the same total cardinality, so
+	// each goroutine gets a similar amount of work.
+	var total int
+	for _, card := range containers {
+		total += card
+	}
+	n := dst.keys.numKeys()
 	var wg sync.WaitGroup
-	var res []*Bitmap
-	for start := 0; start < len(bitmaps); start += width {
-		end := min(start+width, len(bitmaps))
-		res = append(res, nil) // Make space for result.
-		wg.Add(1)
-
-		go func(start, end int) {
-			idx := start / width
-			res[idx] = FastOr(bitmaps[start:end]...)
-			wg.Done()
-		}(start, end)
+	process := func(start, end int) {
+		defer wg.Done()
+		acc := make([]uint16, maxContainerSize)
+		vals := make([]uint16, maxContainerSize)
+		conts := make([][]uint16, 0, len(bitmaps))
+		cursors := make([]int, len(bitmaps))
+		for j, b := range bitmaps {
+			cursors[j] = b.keys.search(dst.keys.key(start))
+		}
+		for i := start; i < end; i++ {
+			key := dst.keys.key(i)
+			conts = conts[:0]
+			for j, b := range bitmaps {
+				if c := b.seekContainer(key, &cursors[j]); c != nil && getCardinality(c) > 0 {
+					conts = append(conts, c)
+				}
+			}
+			orContainers(dst.getContainer(dst.keys.val(i)), conts, acc, vals)
+		}
+	}
+	var start, sum, part int
+	for i := 0; i < n; i++ {
+		sum += containers[dst.keys.key(i)]
+		if i == n-1 || (part < numGo-1 && sum*numGo >= total*(part+1)) {
+			wg.Add(1)
+			go process(start, i+1)
+			start = i + 1
+			part++
+		}
 	}
 	wg.Wait()
-	return FastOr(res...)
+	return dst
+}
+
+// orContainers writes the union of the containers conts into dst, which must
+// have been sized by newPresizedBitmap. acc and vals are used as scratch space,
+// and must be able to hold a bitmap container. conts gets overwritten.
+func orContainers(dst []uint16, conts [][]uint16, acc, vals []uint16) {
+	var card int
+	var hasBitmap bool
+	for _, c := range conts {
+		card += getCardinality(c)
+		hasBitmap = hasBitmap || c[indexType] == typeBitmap
+	}
+
+	// Merging the sorted elements of the containers pairwise takes about
+	// log2(len(conts)) passes over them, while going through a bitmap costs
+	// about a pass over its 4096 words, to zero them out and to count and
+	// decode its bits. So, sparse containers are merged, as long as the union
+	// fits in an array.
+	sz := dst[indexSize]
+	if sz < maxContainerSize && !hasBitmap && card*bits.Len(uint(len(conts)-1)) <= 1<<12 {
+		// The elements of run containers are expanded into vals first.
+		lists := conts[:0]
+		var off int
+		for _, c := range conts {
+			if c[indexType] == typeArray {
+				lists = append(lists, array(c).all())
+				continue
+			}
+			r, start := run(c), off
+			for i := 0; i < r.numRuns(); i++ {
+				for x := uint32(r.start(i)); x <= uint32(r.last(i)); x++ {
+					vals[off] = uint16(x)
+					off++
+				}
+			}
+			lists = append(lists, vals[start:off])
+		}
+		// Each round merges the lists in pairs, alternating between acc and vals
+		// for the output.
+		for round := 0; len(lists) > 1; round++ {
+			out := acc
+			if round%2 == 1 {
+				out = vals
+			}
+			var off, n int
+			for i := 0; i < len(lists); i += 2 {
+				var m int
+				if i+1 < len(lists) {
+					m = union2by2(lists[i], lists[i+1], out[off:])
+				} else {
+					m = copy(out[off:], lists[i])
+				}
+				lists[n] = out[off : off+m]
+				n++
+				off += m
+			}
+			lists = lists[:n]
+		}
+
+		var n int
+		if len(lists) > 0 {
+			n = copy(dst[startIdx:sz], lists[0])
+		}
+		dst[indexType] = typeArray
+		setCardinality(dst, n)
+		return
+	}
+
+	copy(acc, zeroContainer)
+	acc[indexSize] = maxContainerSize
+	acc[indexType] = typeBitmap
+	for _, c := range conts {
+		containerOr(acc, c, nil, runInline|runLazy)
+	}
+	calculateAndSetCardinality(acc)
+
+	if sz == maxContainerSize {
+		copy(dst, acc)
+	} else {
+		// The container was sized to hold all the elements as an array.
+		bitmap(acc).toArrayContainer(dst)
+		dst[indexSize] = sz
+	}
 }
 
 // FastOr would merge given Bitmaps into one Bitmap. This is faster than
@@ -1144,19 +1883,212 @@ func FastOr(bitmaps ...*Bitmap) *Bitmap {
 	// assume the worst-case scenario where the union would result in a
 	// cardinality (per container) of the sum of cardinalities of each of the
 	// corresponding containers in other bitmaps.
-	containers := make(map[uint64]int)
+	containers, _ := keyDistribution(bitmaps)
+
+	// We use the above information to pre-generate the destination Bitmap and
+	// allocate container sizes based on the calculated cardinalities.
+	dst := newPresizedBitmap(containers)
+
+	// dst Bitmap is ready to be ORed with the given Bitmaps.
+	for _, b := range bitmaps {
+		dst.or(b, runLazy)
+	}
+	dst.fixCardinalities()
+	return dst
+}
+
+// FastXor would compute the symmetric difference of the given Bitmaps, i.e.
+// the elements present in an odd number of them. Just like FastOr, it
+// pre-generates the destination Bitmap based on the container distribution
+// across the bitmaps. This is faster than doing a XOR over the bitmaps
+// iteratively.
+func FastXor(bitmaps ...*Bitmap) *Bitmap {
+	if len(bitmaps) == 0 {
+		return NewBitmap()
+	}
+	if len(bitmaps) == 1 {
+		return bitmaps[0]
+	}
+
+	// The cardinality of the symmetric difference can't exceed the cardinality
+	// of the union. So, the containers can be pre-sized the same way as FastOr.
+	containers, _ := keyDistribution(bitmaps)
+	dst := newPresizedBitmap(containers)
+	for _, b := range bitmaps {
+		dst.xor(b, runLazy)
+	}
+	dst.fixCardinalities()
+
+	// Unlike a union, the symmetric difference can leave empty containers behind.
+	dst.Cleanup()
+	return dst
+}
+
+// FastThreshold returns the elements present in at least k of the given
+// Bitmaps. With k=1, this is the same as FastOr, and with k=len(bitmaps), the
+// same as FastAnd.
+//
+// It works per container key. The key distribution across the bitmaps allows
+// skipping the keys present in fewer than k bitmaps. For the remaining keys,
+// the number of occurrences of each element is tracked via bit-sliced
+// counters.
+func FastThreshold(k int, bitmaps ...*Bitmap) *Bitmap {
+	if k <= 1 {
+		return FastOr(bitmaps...)
+	}
+	if k > len(bitmaps) {
+		return NewBitmap()
+	}
+
+	_, counts := keyDistribution(bitmaps)
+	var keys []uint64
+	for key, num := range counts {
+		if num >= k {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	res := NewBitmap()
+	counter := newBitCounter(k)
+	buf := make([]uint16, maxContainerSize)
+	for _, key := range keys {
+		counter.reset()
+		for _, b := range bitmaps {
+			if offset, has := b.keys.getValue(key); has {
+				counter.add(b.getContainer(offset))
+			}
+		}
+		c := counter.atLeast(k, buf)
+		if getCardinality(c) == 0 {
+			continue
+		}
+		offset := res.newContainer(uint16(len(c)))
+		copy(res.getContainer(offset), c)
+		res.setKey(key, offset)
+	}
+	return res
+}
+
+// FastAndNot returns the elements of base which aren't present in any of the
+// others. It doesn't modify any of the given Bitmaps. For every key of base,
+// the containers of the others are first ORed together lazily, and the result
+// is subtracted from the container of base once. The containers of the result
+// are stored compactly, without any slack.
+func FastAndNot(base *Bitmap, others ...*Bitmap) *Bitmap {
+	res := NewBitmap()
+	if base == nil {
+		return res
+	}
+
+	buf := make([]uint16, maxContainerSize)
+	acc := make([]uint16, maxContainerSize)
+	work := make([]uint16, maxContainerSize)
+	cursors := make([]int, len(others))
+	for i := 0; i < base.keys.numKeys(); i++ {
+		key := base.keys.key(i)
+		c := base.getContainer(base.keys.val(i))
+		if getCardinality(c) == 0 {
+			continue
+		}
+
+		// Find the containers to subtract. If there are more than one, OR them
+		// into acc.
+		var sub []uint16
+		var num int
+		for j, o := range others {
+			if o == nil {
+				continue
+			}
+			oc := o.seekContainer(key, &cursors[j])
+			if oc == nil || getCardinality(oc) == 0 {
+				continue
+			}
+			num++
+			switch num {
+			case 1:
+				sub = oc
+				continue
+			case 2:
+				copy(acc, zeroContainer)
+				acc[indexSize] = maxContainerSize
+				acc[indexType] = typeBitmap
+				containerOr(acc, sub, nil, runInline|runLazy)
+				sub = acc
+			}
+			containerOr(acc, oc, nil, runInline|runLazy)
+		}
+
+		if num > 1 {
+			calculateAndSetCardinality(acc)
+		}
+		if num > 0 {
+			if c[indexType] == typeBitmap {
+				// Subtracting from a bitmap container happens in place. So, work
+				// on a copy to avoid modifying base.
+				copy(work, c)
+				c = work
+			}
+			c = containerAndNot(c, sub, buf)
+		}
+		res.addCompact(key, c)
+	}
+	return res
+}
+
+// addCompact adds the container c for the given key, taking up as little space
+// as possible. The container is converted to the type of container with the
+// smallest size. Empty containers are skipped. c is not modified.
+func (ra *Bitmap) addCompact(key uint64, c []uint16) {
+	if getCardinality(c) == 0 {
+		return
+	}
+	sz, _ := minimalSize(c)
+	offset := ra.newContainer(uint16(sz))
+	minimalContainer(c, ra.data[offset:offset+uint64(sz)])
+	ra.setKey(key, offset)
+}
+
+// seekContainer returns the container for the given key, or nil if there's
+// none. It starts looking from the key at index *cursor, and moves the cursor
+// past the given key. So, it should be called with increasing keys.
+func (ra *Bitmap) seekContainer(key uint64, cursor *int) []uint16 {
+	idx, n := *cursor, ra.keys.numKeys()
+	for idx < n && ra.keys.key(idx) < key {
+		idx++
+	}
+	var c []uint16
+	if idx < n && ra.keys.key(idx) == key {
+		c = ra.getContainer(ra.keys.val(idx))
+		idx++
+	}
+	*cursor = idx
+	return c
+}
+
+// keyDistribution returns the sum of the cardinalities of the containers
+// across the given bitmaps, per container key. It also returns the number of
+// bitmaps having a non-empty container, per container key.
+func keyDistribution(bitmaps []*Bitmap) (cards, counts map[uint64]int) {
+	cards = make(map[uint64]int)
+	counts = make(map[uint64]int)
 	for _, b := range bitmaps {
 		for i := 0; i < b.keys.numKeys(); i++ {
 			offset := b.keys.val(i)
 			cont := b.getContainer(offset)
 			card := getCardinality(cont)
-			containers[b.keys.key(i)] += card
+			cards[b.keys.key(i)] += card
+			if card > 0 {
+				counts[b.keys.key(i)]++
+			}
 		}
 	}
+	return cards, counts
+}
 
-	// We use the above information to pre-generate the destination Bitmap and
-	// allocate container sizes based on the calculated cardinalities.
-	// var sz int
+// newPresizedBitmap creates a Bitmap with a container for each key in
+// containers, sized based on the expected cardinality of the container.
+func newPresizedBitmap(containers map[uint64]int) *Bitmap {
 	dst := NewBitmap()
 	// First create the keys. We do this as a separate step, because keys are
 	// the left most portion of the data array. Adding space there requires
@@ -1183,31 +2115,32 @@ func FastOr(bitmaps ...*Bitmap) *Bitmap {
 	for key, card := range containers {
 		// Ensure this condition exactly maps up with above.
 		if card < 4096 && card > 0 {
-			if card < minContainerSize {
-				card = minContainerSize
+			// Leave space for the header, and the spare slot at the end, so
+			// the union of all the containers fits as an array.
+			sz := card + int(startIdx) + 1
+			if sz < minContainerSize {
+				sz = minContainerSize
 			}
-			offset := dst.newContainer(uint16(card))
+			offset := dst.newContainer(uint16(sz))
 			c := dst.getContainer(offset)
-			c[indexSize] = uint16(card)
+			c[indexSize] = uint16(sz)
 			c[indexType] = typeArray
 			dst.setKey(key, offset)
 		}
 	}
+	return dst
+}
 
-	// dst Bitmap is ready to be ORed with the given Bitmaps.
-	for _, b := range bitmaps {
-		dst.or(b, runLazy)
-	}
-
-	for i := 0; i < dst.keys.numKeys(); i++ {
-		offset := dst.keys.val(i)
-		c := dst.getContainer(offset)
+// fixCardinalities calculates the cardinality of the containers which were
+// operated upon in runLazy mode.
+func (ra *Bitmap) fixCardinalities() {
+	for i := 0; i < ra.keys.numKeys(); i++ {
+		offset := ra.keys.val(i)
+		c := ra.getContainer(offset)
 		if getCardinality(c) == invalidCardinality {
 			calculateAndSetCardinality(c)
 		}
 	}
-
-	return dst
 }
 
 // Split splits the bitmap based on maxSz and the externalSize function. It splits the bitmap
@@ -1221,7 +2154,8 @@ func (bm *Bitmap) Split(externalSize func(start, end uint64) uint64, maxSz uint6
 		newBm := NewBitmap()
 		var sz uint64
 		var bms []*Bitmap
-		for id := itr.Next(); id != 0; id = itr.Next() {
+		for itr.HasNext() {
+			id := itr.Next()
 			sz += externalSize(id, id)
 			newBm.Set(id)
 			if sz >= maxSz {
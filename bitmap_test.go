@@ -3,6 +3,8 @@ package sroar
 import (
 	"math"
 	"math/rand"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -420,6 +422,19 @@ func TestAnd2(t *testing.T) {
 	require.Equal(t, n, a.GetCardinality())
 }
 
+func TestAndDifferentKeys(t *testing.T) {
+	// b lacks the container for key 1 that a has, so the keys of a and b must be compared by their
+	// own positions.
+	a := NewBitmap()
+	a.SetMany([]uint64{1, 1<<16 | 1, 2<<16 | 1})
+	b := NewBitmap()
+	b.SetMany([]uint64{2<<16 | 1})
+
+	require.Equal(t, []uint64{2<<16 | 1}, And(a, b).ToArray())
+	a.And(b)
+	require.Equal(t, []uint64{2<<16 | 1}, a.ToArray())
+}
+
 func TestAndNot(t *testing.T) {
 	a := NewBitmap()
 	b := NewBitmap()
@@ -840,6 +855,125 @@ func TestRank(t *testing.T) {
 	}
 }
 
+func TestRankAbsent(t *testing.T) {
+	// Elements missing from the bitmap have no rank, even if they lie between the elements of their
+	// container, whichever its type.
+	var runs, evens []uint64
+	for x := uint64(10); x < 40; x++ {
+		if x < 20 || x >= 30 {
+			runs = append(runs, x)
+		}
+	}
+	for x := uint64(2); x < 10000; x += 2 {
+		evens = append(evens, x)
+	}
+	for typ, vals := range map[uint16][]uint64{
+		typeArray:  {10, 20, 30},
+		typeRun:    runs,
+		typeBitmap: evens,
+	} {
+		a := FromSortedList(vals)
+		require.Equal(t, typ, a.getContainer(a.keys.val(0))[indexType])
+		for i, x := range vals {
+			require.Equal(t, i, a.Rank(x))
+		}
+		require.Equal(t, -1, a.Rank(vals[0]-1))
+		require.Equal(t, -1, a.Rank(25))
+		require.Equal(t, -1, a.Rank(vals[len(vals)-1]+1))
+	}
+}
+
+func TestCardIndex(t *testing.T) {
+	check := func(bm *Bitmap) {
+		arr := bm.ToArray()
+		require.Equal(t, len(arr), bm.GetCardinality())
+		for i := 0; i < 1000; i++ {
+			idx := rand.Intn(len(arr))
+			val, err := bm.Select(uint64(idx))
+			require.NoError(t, err)
+			require.Equal(t, arr[idx], val)
+			require.Equal(t, idx, bm.Rank(arr[idx]))
+		}
+		_, err := bm.Select(uint64(len(arr)))
+		require.Error(t, err)
+		require.NotNil(t, bm.cards.Load())
+		require.Equal(t, len(arr), bm.GetCardinality())
+	}
+
+	a, _ := randomBitmap(100)
+	check(a)
+
+	// Each modification drops the index, which is then rebuilt.
+	mods := []func(){
+		func() { a.Set(120 << 16) },
+		func() { a.SetMany([]uint64{3, 130 << 16}) },
+		func() { a.Remove(120 << 16) },
+		func() { a.SetRange(50<<16+10, 52<<16) },
+		func() { a.RemoveRange(10<<16, 12<<16+100) },
+		func() { a.Flip(30<<16, 31<<16+5) },
+		func() { a.And(Flip(NewBitmap(), 0, 90<<16)) },
+		func() { a.AndNot(FromSortedList([]uint64{3, 60 << 16})) },
+		func() { a.Or(FromSortedList([]uint64{150 << 16})) },
+		func() { a.Xor(FromSortedList([]uint64{3, 4, 160 << 16})) },
+		func() { a.Cleanup() },
+		func() { a.Compact() },
+	}
+	for i, mod := range mods {
+		card := a.GetCardinality()
+		mod()
+		require.Nil(t, a.cards.Load(), "modification: %d", i)
+		if i < 2 {
+			require.Greater(t, a.GetCardinality(), card)
+		}
+		check(a)
+	}
+
+	// Read-only bitmaps build the index lazily, even when shared across goroutines.
+	b := FromBuffer(a.ToBuffer())
+	require.Nil(t, b.cards.Load())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			check(b)
+		}()
+	}
+	wg.Wait()
+
+	a.Reset()
+	require.Nil(t, a.cards.Load())
+	require.Equal(t, 0, a.GetCardinality())
+	// GetCardinality doesn't build the index, it only reads off an existing one.
+	require.Nil(t, a.cards.Load())
+	_, err := a.Select(0)
+	require.Error(t, err)
+	require.NotNil(t, a.cards.Load())
+	require.Equal(t, 0, a.GetCardinality())
+	var nilBm *Bitmap
+	_, err = nilBm.Select(0)
+	require.Error(t, err)
+}
+
+func TestCardinalityAllocs(t *testing.T) {
+	a, _ := randomBitmap(1000)
+	b, _ := randomBitmap(1000)
+	_, err := a.Select(0)
+	require.NoError(t, err)
+
+	// Modifying the bitmap drops the index, but GetCardinality must not rebuild it.
+	var x uint64
+	allocs := testing.AllocsPerRun(100, func() {
+		a.Set(x % 1000)
+		a.Remove(x%1000 + 1)
+		x++
+		a.GetCardinality()
+		OrCardinality(a, b)
+		Jaccard(a, b)
+	})
+	require.Zero(t, allocs)
+}
+
 func TestSplit(t *testing.T) {
 	run := func(n int) {
 		r := NewBitmap()
@@ -859,8 +993,8 @@ func TestSplit(t *testing.T) {
 		id := uint64(1)
 		for _, bm := range bms {
 			itr := bm.NewIterator()
-			for cur := itr.Next(); cur != 0; cur = itr.Next() {
-				require.Equal(t, id, cur)
+			for itr.HasNext() {
+				require.Equal(t, id, itr.Next())
 				id++
 			}
 		}
@@ -871,3 +1005,928 @@ func TestSplit(t *testing.T) {
 	run(1e3)
 	run(1e6)
 }
+
+func TestSplitZero(t *testing.T) {
+	r := NewBitmap()
+	for i := uint64(0); i < 1e4; i++ {
+		r.Set(i)
+	}
+	// The external size makes every container too big, so the containers get split further.
+	f := func(start, end uint64) uint64 { return end - start + 1 }
+	bms := r.Split(f, 1<<10)
+	require.Greater(t, len(bms), 1)
+
+	var all []uint64
+	for _, bm := range bms {
+		all = append(all, bm.ToArray()...)
+	}
+	require.Equal(t, r.ToArray(), all)
+}
+
+func TestArrayContainer(t *testing.T) {
+	c := make([]uint16, 2048)
+	c[indexSize] = 2048
+	c[indexType] = typeArray
+	a := array(c)
+
+	m := make(map[uint16]struct{})
+	check := func() {
+		all := a.all()
+		require.Equal(t, len(m), len(all))
+		for i, x := range all {
+			require.True(t, a.has(x))
+			require.Equal(t, i, a.rank(x))
+			require.Equal(t, i, a.find(x))
+			if i > 0 {
+				require.Less(t, all[i-1], x)
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			x := uint16(rand.Intn(1 << 16))
+			_, has := m[x]
+			require.Equal(t, has, a.has(x))
+			idx := sort.Search(len(all), func(i int) bool { return all[i] >= x })
+			require.Equal(t, idx, a.find(x))
+			if !has {
+				require.Equal(t, -1, a.rank(x))
+			}
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		x := uint16(rand.Intn(1 << 16))
+		_, has := m[x]
+		require.Equal(t, !has, a.add(x))
+		m[x] = struct{}{}
+	}
+	check()
+	for x := range m {
+		if rand.Intn(2) == 0 {
+			require.True(t, a.remove(x))
+			require.False(t, a.remove(x))
+			delete(m, x)
+		}
+	}
+	check()
+	a.removeRange(1000, 50000)
+	for x := range m {
+		if x >= 1000 && x <= 50000 {
+			delete(m, x)
+		}
+	}
+	check()
+}
+
+func TestBitmapContainer(t *testing.T) {
+	c := make([]uint16, maxContainerSize)
+	c[indexSize] = maxContainerSize
+	c[indexType] = typeBitmap
+	b := bitmap(c)
+	for i := 0; i < 20000; i++ {
+		b.add(uint16(rand.Intn(1 << 16)))
+	}
+	b.add(0)
+	b.add(math.MaxUint16)
+	setCardinality(c, b.cardinality())
+
+	all := b.all()
+	for i, x := range all {
+		require.Equal(t, i, b.rank(x))
+		require.Equal(t, x, b.selectAt(i))
+	}
+	for x := 0; x < 1<<16; x++ {
+		if !b.has(uint16(x)) {
+			require.Equal(t, -1, b.rank(uint16(x)))
+		}
+	}
+}
+
+func TestSelect64(t *testing.T) {
+	for _, w := range []uint64{1, 1 << 63, math.MaxUint64, 0x8000000000000001, rand.Uint64()} {
+		var k int
+		for pos := 0; pos < 64; pos++ {
+			if w&(1<<pos) > 0 {
+				require.Equal(t, pos, select64(w, k), "word: %#x, k: %d", w, k)
+				k++
+			}
+		}
+	}
+}
+
+func TestRunContainer(t *testing.T) {
+	c := make([]uint16, 512)
+	c[indexSize] = 512
+	c[indexType] = typeRun
+	r := run(c)
+
+	m := make(map[uint16]struct{})
+	check := func() {
+		require.Equal(t, len(m), getCardinality(r))
+		require.Equal(t, len(m), r.cardinality())
+		all := r.all()
+		require.Equal(t, len(m), len(all))
+		for i, x := range all {
+			_, has := m[x]
+			require.True(t, has)
+			require.Equal(t, i, r.rank(x))
+			require.Equal(t, x, r.selectAt(i))
+			if i > 0 {
+				require.Less(t, all[i-1], x)
+			}
+		}
+		for i := 0; i+1 < r.numRuns(); i++ {
+			// Runs must never overlap or be adjacent.
+			require.Less(t, uint32(r.last(i))+1, uint32(r.start(i+1)))
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		x := uint16(rand.Intn(2000))
+		_, has := m[x]
+		if rand.Intn(3) == 0 {
+			require.Equal(t, has, r.remove(x))
+			delete(m, x)
+		} else {
+			require.Equal(t, !has, r.add(x))
+			m[x] = struct{}{}
+		}
+		_, has = m[x]
+		require.Equal(t, has, r.has(x))
+		if r.numRuns() > 200 {
+			lo := uint16(rand.Intn(2000))
+			hi := lo + uint16(rand.Intn(200))
+			r.removeRange(lo, hi)
+			for x := range m {
+				if x >= lo && x <= hi {
+					delete(m, x)
+				}
+			}
+		}
+		check()
+	}
+}
+
+func TestRunContainerSet(t *testing.T) {
+	a := NewBitmap()
+	N := uint64(1e6)
+	for i := uint64(0); i < N; i++ {
+		a.Set(i)
+	}
+	require.Equal(t, int(N), a.GetCardinality())
+	for i := 0; i < a.keys.numKeys(); i++ {
+		c := a.getContainer(a.keys.val(i))
+		require.Equal(t, typeRun, c[indexType])
+		require.LessOrEqual(t, len(c), minContainerSize)
+	}
+
+	// Punch holes in the runs and check that the containers grow as needed.
+	for i := uint64(0); i < N; i += 3 {
+		require.True(t, a.Remove(i))
+	}
+	for i := uint64(0); i < N; i++ {
+		require.Equal(t, i%3 != 0, a.Contains(i))
+	}
+	require.Equal(t, int(N-N/3-1), a.GetCardinality())
+
+	a.RemoveRange(10, N-10)
+	var exp []uint64
+	for i := uint64(0); i < N; i++ {
+		if i%3 != 0 && (i < 10 || i >= N-10) {
+			exp = append(exp, i)
+		}
+	}
+	require.Equal(t, exp, a.ToArray())
+}
+
+func TestRunContainerFull(t *testing.T) {
+	// A new container gets space for one more run than it needs. Fill it up with a second run.
+	a := NewBitmap()
+	a.SetRange(1<<16+10, 1<<16+20)
+	a.SetRange(2<<16, 2<<16+5)
+	require.True(t, a.Set(1<<16+30))
+	r := run(a.getContainer(a.keys.val(1)))
+	require.Equal(t, typeRun, r[indexType])
+	require.True(t, r.isFull())
+
+	// Setting an element already in a run, or removing one not in any run, leaves the container as
+	// it is. So, it doesn't need to be expanded.
+	moved := a.memMoved
+	require.False(t, a.Set(1<<16+15))
+	require.False(t, a.Remove(1<<16+100))
+	require.Equal(t, moved, a.memMoved)
+	require.True(t, r.isFull())
+
+	// Otherwise, the container is expanded to make space for another run.
+	require.True(t, a.Set(1<<16+100))
+	require.True(t, a.Remove(1<<16+15))
+	require.Greater(t, a.memMoved, moved)
+	requireElements(t, a, 3<<16, func(x uint64) bool {
+		y := x - 1<<16
+		return (x >= 1<<16 && y >= 10 && y < 20 && y != 15) || y == 30 || y == 100 ||
+			(x >= 2<<16 && x < 2<<16+5)
+	})
+}
+
+// randomBitmap generates a bitmap with numKeys containers, which are a mix of array, bitmap and run
+// containers. It also returns the elements of the bitmap as a map.
+func randomBitmap(numKeys int) (*Bitmap, map[uint64]struct{}) {
+	m := make(map[uint64]struct{})
+	for key := uint64(0); key < uint64(numKeys); key++ {
+		base := key << 16
+		switch rand.Intn(4) {
+		case 0:
+			// Sparse, array container.
+			for i := 0; i < 100; i++ {
+				m[base+uint64(rand.Intn(1<<16))] = struct{}{}
+			}
+		case 1:
+			// Dense, bitmap container.
+			for i := 0; i < 10000; i++ {
+				m[base+uint64(rand.Intn(1<<16))] = struct{}{}
+			}
+		case 2:
+			// Long ranges, run container.
+			for i := 0; i < 10; i++ {
+				lo := rand.Intn(1 << 16)
+				hi := min(lo+rand.Intn(10000), 1<<16)
+				for x := lo; x < hi; x++ {
+					m[base+uint64(x)] = struct{}{}
+				}
+			}
+		}
+	}
+	var arr []uint64
+	for x := range m {
+		arr = append(arr, x)
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i] < arr[j] })
+	return FromSortedList(arr), m
+}
+
+// requireElements checks that bm holds exactly the elements in [0, max) for which fn returns true.
+func requireElements(t *testing.T, bm *Bitmap, max uint64, fn func(x uint64) bool) {
+	var exp []uint64
+	for x := uint64(0); x < max; x++ {
+		if fn(x) {
+			exp = append(exp, x)
+		}
+	}
+	require.Equal(t, len(exp), bm.GetCardinality())
+	if len(exp) == 0 {
+		require.Empty(t, bm.ToArray())
+	} else {
+		require.Equal(t, exp, bm.ToArray())
+	}
+	itr := bm.NewIterator()
+	for _, x := range exp {
+		require.True(t, itr.HasNext())
+		require.Equal(t, x, itr.Next())
+	}
+	require.False(t, itr.HasNext())
+}
+
+func TestRunContainerOps(t *testing.T) {
+	has := func(m map[uint64]struct{}, x uint64) bool {
+		_, ok := m[x]
+		return ok
+	}
+	verify := func(bm *Bitmap, fn func(x uint64) bool) {
+		requireElements(t, bm, 8<<16, fn)
+	}
+
+	for i := 0; i < 10; i++ {
+		a, am := randomBitmap(8)
+		b, bm := randomBitmap(8)
+
+		verify(Or(a, b), func(x uint64) bool { return has(am, x) || has(bm, x) })
+		verify(FastOr(a, b), func(x uint64) bool { return has(am, x) || has(bm, x) })
+		verify(And(a, b), func(x uint64) bool { return has(am, x) && has(bm, x) })
+
+		c := a.Clone()
+		c.And(b)
+		verify(c, func(x uint64) bool { return has(am, x) && has(bm, x) })
+
+		c = a.Clone()
+		c.Or(b)
+		verify(c, func(x uint64) bool { return has(am, x) || has(bm, x) })
+
+		c = a.Clone()
+		c.AndNot(b)
+		verify(c, func(x uint64) bool { return has(am, x) && !has(bm, x) })
+	}
+}
+
+func TestAndRunsInOneWord(t *testing.T) {
+	// a holds a bitmap container, and b a run container with several runs in the same 16-bit word.
+	vals := []uint64{}
+	for x := uint64(0); x < 16; x++ {
+		vals = append(vals, x)
+	}
+	for x := uint64(16); x < 8000; x += 2 {
+		vals = append(vals, x)
+	}
+	a := FromSortedList(vals)
+	require.Equal(t, typeBitmap, a.getContainer(a.keys.val(0))[indexType])
+	b := FromSortedList([]uint64{0, 1, 2, 3, 8, 9, 10})
+	require.Equal(t, typeRun, b.getContainer(b.keys.val(0))[indexType])
+
+	exp := []uint64{0, 1, 2, 3, 8, 9, 10}
+	check := func(res *Bitmap) {
+		require.Equal(t, len(exp), res.GetCardinality())
+		require.Equal(t, exp, res.ToArray())
+	}
+	check(And(a, b))
+	check(And(b, a))
+	check(FastAnd(a.Clone(), b))
+	check(FastAnd(b.Clone(), a))
+}
+
+func TestXor(t *testing.T) {
+	a := NewBitmap()
+	b := NewBitmap()
+	N := int(1e6)
+	for i := 0; i < N; i++ {
+		if i%2 == 0 {
+			a.Set(uint64(i))
+		}
+		if i%3 == 0 {
+			b.Set(uint64(i))
+		}
+	}
+	check := func(bm *Bitmap) {
+		requireElements(t, bm, uint64(N), func(x uint64) bool { return (x%2 == 0) != (x%3 == 0) })
+	}
+	check(Xor(a, b))
+	check(FastXor(a, b))
+	a.Xor(b)
+	check(a)
+
+	// Xor with itself should leave nothing behind.
+	a.Xor(a.Clone())
+	require.Equal(t, 0, a.GetCardinality())
+	require.Equal(t, 1, a.keys.numKeys())
+}
+
+func TestXorMixed(t *testing.T) {
+	var bitmaps []*Bitmap
+	var maps []map[uint64]struct{}
+	for i := 0; i < 5; i++ {
+		bm, m := randomBitmap(8)
+		bitmaps = append(bitmaps, bm)
+		maps = append(maps, m)
+	}
+	odd := func(ms ...map[uint64]struct{}) func(x uint64) bool {
+		return func(x uint64) bool {
+			var cnt int
+			for _, m := range ms {
+				if _, ok := m[x]; ok {
+					cnt++
+				}
+			}
+			return cnt%2 == 1
+		}
+	}
+
+	requireElements(t, Xor(bitmaps[0], bitmaps[1]), 8<<16, odd(maps[0], maps[1]))
+	requireElements(t, FastXor(bitmaps...), 8<<16, odd(maps...))
+
+	c := bitmaps[0].Clone()
+	for _, bm := range bitmaps[1:] {
+		c.Xor(bm)
+	}
+	requireElements(t, c, 8<<16, odd(maps...))
+}
+
+func TestXorRuns(t *testing.T) {
+	// Small universe, so that adjacent and touching runs are common.
+	randomSet := func() []uint16 {
+		var set []uint16
+		for x := uint16(0); x < 32; x++ {
+			if rand.Intn(2) == 0 {
+				set = append(set, x)
+			}
+		}
+		return set
+	}
+	for i := 0; i < 1000; i++ {
+		a, b := randomSet(), randomSet()
+		ar := make([]uint16, 2*len(a))
+		n := unionRuns(arrayRuns(a), nil, ar)
+
+		out := make([]uint16, 2*(len(a)+len(b)))
+		n = xorRuns(ar[:2*n], arrayRuns(b), out)
+
+		got := []uint16{}
+		for j := 0; j < n; j++ {
+			require.LessOrEqual(t, out[2*j], out[2*j+1])
+			for x := out[2*j]; x <= out[2*j+1]; x++ {
+				got = append(got, x)
+			}
+		}
+		exp := make([]uint16, 32)
+		require.Equal(t, exp[:exclusiveUnion2by2(a, b, exp)], got)
+	}
+}
+
+func TestSetRange(t *testing.T) {
+	a, am := randomBitmap(8)
+	has := func(x uint64) bool {
+		_, ok := am[x]
+		return ok
+	}
+
+	// Ranges within a container, spanning a container boundary and spanning multiple containers.
+	ranges := [][2]uint64{{10, 20}, {65530, 65540}, {3<<16 + 100, 6<<16 + 100}, {7 << 16, 8 << 16}}
+	for _, r := range ranges {
+		a.SetRange(r[0], r[1])
+	}
+	requireElements(t, a, 8<<16, func(x uint64) bool {
+		for _, r := range ranges {
+			if x >= r[0] && x < r[1] {
+				return true
+			}
+		}
+		return has(x)
+	})
+
+	// Set and remove elements from the containers created by SetRange.
+	b := NewBitmap()
+	N := uint64(1e6)
+	b.SetRange(0, N)
+	require.Equal(t, int(N), b.GetCardinality())
+	for i := uint64(0); i < N; i += 2 {
+		require.True(t, b.Remove(i))
+	}
+	require.False(t, b.Set(N-1))
+	require.True(t, b.Set(N))
+	requireElements(t, b, N+1, func(x uint64) bool { return x%2 == 1 || x == N })
+
+	// The range close to the end of uint64 shouldn't overflow.
+	c := NewBitmap()
+	c.SetRange(math.MaxUint64-(1<<17), math.MaxUint64)
+	require.Equal(t, 1<<17, c.GetCardinality())
+	require.False(t, c.Contains(math.MaxUint64))
+	require.True(t, c.Contains(math.MaxUint64-1))
+	require.Equal(t, uint64(math.MaxUint64-(1<<17)), c.Minimum())
+}
+
+func TestFlip(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		a, am := randomBitmap(8)
+		has := func(x uint64) bool {
+			_, ok := am[x]
+			return ok
+		}
+
+		// Ranges within a container, spanning a container boundary and spanning multiple
+		// containers, going beyond the containers present in the bitmap.
+		ranges := [][2]uint64{{10, 20}, {65530, 65540}, {3<<16 + 100, 6<<16 + 100}, {7 << 16, 10 << 16}}
+		flipped := func(x uint64) bool {
+			in := false
+			for _, r := range ranges {
+				if x >= r[0] && x < r[1] {
+					in = !in
+				}
+			}
+			return in != has(x)
+		}
+
+		b := a
+		for _, r := range ranges {
+			b = Flip(b, r[0], r[1])
+		}
+		requireElements(t, b, 10<<16, flipped)
+		// Flip shouldn't modify its input.
+		requireElements(t, a, 10<<16, has)
+
+		for _, r := range ranges {
+			a.Flip(r[0], r[1])
+		}
+		requireElements(t, a, 10<<16, flipped)
+
+		// Flipping the same ranges again gives back the original elements.
+		for _, r := range ranges {
+			a.Flip(r[0], r[1])
+		}
+		requireElements(t, a, 10<<16, has)
+	}
+
+	// A dense bitmap container which ends up with only a few elements gets converted to an array
+	// container. It should still allow adding elements to it.
+	var arr []uint64
+	for x := uint64(0); x < 1<<16; x += 3 {
+		arr = append(arr, x)
+	}
+	a := FromSortedList(arr)
+	a.Flip(0, 60000)
+	b := Flip(FromSortedList(arr), 0, 60000)
+	for _, bm := range []*Bitmap{a, b} {
+		for x := uint64(0); x < 1<<16; x += 5 {
+			bm.Set(x)
+		}
+		requireElements(t, bm, 1<<16, func(x uint64) bool {
+			return x%5 == 0 || (x < 60000) != (x%3 == 0)
+		})
+	}
+
+	// Flipping an empty bitmap sets the whole range.
+	c := NewBitmap()
+	c.Flip(math.MaxUint64-(1<<17), math.MaxUint64)
+	require.Equal(t, 1<<17, c.GetCardinality())
+	require.False(t, c.Contains(math.MaxUint64))
+	c.Flip(math.MaxUint64-(1<<17), math.MaxUint64)
+	require.Equal(t, 0, c.GetCardinality())
+}
+
+func TestCardinalityOps(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		a, am := randomBitmap(8)
+		b, bm := randomBitmap(8)
+
+		var and, or int
+		for x := range am {
+			if _, ok := bm[x]; ok {
+				and++
+			}
+		}
+		or = len(am) + len(bm) - and
+
+		require.Equal(t, and, AndCardinality(a, b))
+		require.Equal(t, and, AndCardinality(b, a))
+		require.Equal(t, or, OrCardinality(a, b))
+		require.Equal(t, len(am)-and, AndNotCardinality(a, b))
+		require.Equal(t, len(bm)-and, AndNotCardinality(b, a))
+		require.Equal(t, or-and, XorCardinality(a, b))
+		require.Equal(t, and > 0, Intersects(a, b))
+
+		require.Equal(t, And(a, b).GetCardinality(), AndCardinality(a, b))
+		require.Equal(t, Or(a, b).GetCardinality(), OrCardinality(a, b))
+		c := a.Clone()
+		c.AndNot(b)
+		require.Equal(t, c.GetCardinality(), AndNotCardinality(a, b))
+		require.Equal(t, Xor(a, b).GetCardinality(), XorCardinality(a, b))
+
+		// None of these should allocate.
+		allocs := testing.AllocsPerRun(10, func() {
+			AndCardinality(a, b)
+			OrCardinality(a, b)
+			AndNotCardinality(a, b)
+			XorCardinality(a, b)
+			Intersects(a, b)
+		})
+		require.Equal(t, 0.0, allocs)
+	}
+
+	// Bitmaps with the same keys, but no elements in common.
+	a, b := NewBitmap(), NewBitmap()
+	for x := uint64(0); x < 1e5; x++ {
+		a.Set(2 * x)
+		b.Set(2*x + 1)
+	}
+	a.SetRange(1e6, 2e6)
+	b.SetRange(2e6, 3e6)
+	require.False(t, Intersects(a, b))
+	require.Equal(t, 0, AndCardinality(a, b))
+	require.Equal(t, a.GetCardinality()+b.GetCardinality(), XorCardinality(a, b))
+
+	b.Set(1e6)
+	require.True(t, Intersects(a, b))
+	require.Equal(t, 1, AndCardinality(a, b))
+
+	require.False(t, Intersects(a, nil))
+	require.Equal(t, a.GetCardinality(), OrCardinality(a, nil))
+}
+
+func TestEquals(t *testing.T) {
+	a, am := randomBitmap(8)
+
+	// Build the same set of elements differently, so the containers have different types, sizes
+	// and slack.
+	b := NewBitmap()
+	for x := range am {
+		b.Set(x)
+	}
+	b.Set(100 << 16)
+	b.Remove(100 << 16)
+	require.True(t, Equals(a, b))
+	require.True(t, Equals(b, a))
+	require.True(t, a.IsSubsetOf(b))
+	require.True(t, b.IsSubsetOf(a))
+	require.Equal(t, 1.0, Jaccard(a, b))
+
+	// Remove an element from b.
+	var x uint64
+	for x = range am {
+		break
+	}
+	b.Remove(x)
+	require.False(t, Equals(a, b))
+	require.True(t, b.IsSubsetOf(a))
+	require.False(t, a.IsSubsetOf(b))
+	n := float64(len(am))
+	require.Equal(t, (n-1)/n, Jaccard(a, b))
+
+	// Add an element which isn't present in a.
+	b.Set(x)
+	b.Set(9 << 16)
+	require.False(t, Equals(a, b))
+	require.True(t, a.IsSubsetOf(b))
+	require.False(t, b.IsSubsetOf(a))
+
+	// A run container and an array container with the same elements.
+	c, d := NewBitmap(), NewBitmap()
+	c.SetRange(10, 100)
+	for x := uint64(10); x < 100; x++ {
+		d.Set(x)
+	}
+	require.True(t, Equals(c, d))
+	d.Remove(50)
+	require.False(t, Equals(c, d))
+	require.True(t, d.IsSubsetOf(c))
+	require.Equal(t, 89.0/90.0, Jaccard(c, d))
+
+	// Empty bitmaps.
+	e := NewBitmap()
+	e.Set(1 << 20)
+	e.Remove(1 << 20)
+	require.True(t, Equals(e, NewBitmap()))
+	require.True(t, Equals(e, nil))
+	require.False(t, Equals(c, nil))
+	require.True(t, e.IsSubsetOf(c))
+	require.True(t, e.IsSubsetOf(nil))
+	require.False(t, c.IsSubsetOf(e))
+	require.Equal(t, 1.0, Jaccard(e, nil))
+	require.Equal(t, 0.0, Jaccard(c, e))
+}
+
+func TestFastThreshold(t *testing.T) {
+	var bitmaps []*Bitmap
+	count := make(map[uint64]int)
+	for i := 0; i < 5; i++ {
+		bm, m := randomBitmap(6)
+		bitmaps = append(bitmaps, bm)
+		for x := range m {
+			count[x]++
+		}
+	}
+	// A key present in only one of the bitmaps.
+	bitmaps[0].Set(7<<16 + 1)
+	count[7<<16+1]++
+
+	for k := 0; k <= len(bitmaps)+1; k++ {
+		res := FastThreshold(k, bitmaps...)
+		requireElements(t, res, 8<<16, func(x uint64) bool {
+			return count[x] > 0 && count[x] >= k
+		})
+	}
+
+	// Counts overflowing the bit-sliced counters.
+	a := NewBitmap()
+	a.SetRange(0, 1e5)
+	b := NewBitmap()
+	b.SetRange(0, 1e4)
+	res := FastThreshold(2, a, a, a, a, b)
+	requireElements(t, res, 2e5, func(x uint64) bool { return x < 1e5 })
+	res = FastThreshold(5, a, a, a, a, b)
+	requireElements(t, res, 2e5, func(x uint64) bool { return x < 1e4 })
+}
+
+func TestFastAnd(t *testing.T) {
+	var bitmaps, clones []*Bitmap
+	count := make(map[uint64]int)
+	for i := 0; i < 4; i++ {
+		bm, m := randomBitmap(8)
+		// Make the bitmaps overlap more, so the intersection isn't empty.
+		bm.SetRange(1<<16, 3<<16)
+		for x := uint64(1 << 16); x < 3<<16; x++ {
+			m[x] = struct{}{}
+		}
+		for x := range m {
+			count[x]++
+		}
+		// The inputs are read-only bitmaps.
+		bitmaps = append(bitmaps, FromBuffer(bm.ToBuffer()))
+		clones = append(clones, bm.Clone())
+	}
+	all := func(x uint64) bool { return count[x] == len(bitmaps) }
+
+	requireElements(t, FastAnd(bitmaps...), 8<<16, all)
+	for _, numGo := range []int{1, 2, 3, 16} {
+		requireElements(t, FastParAnd(numGo, bitmaps...), 8<<16, all)
+	}
+	// None of the inputs should be modified, including their order.
+	for i := range bitmaps {
+		require.True(t, Equals(clones[i], bitmaps[i]))
+		require.Equal(t, clones[i].ToBuffer(), bitmaps[i].ToBuffer())
+	}
+
+	// The result can be modified.
+	res := FastAnd(bitmaps[0])
+	res.Set(100 << 16)
+	require.True(t, Equals(clones[0], bitmaps[0]))
+
+	require.True(t, FastAnd().IsEmpty())
+	require.True(t, FastAnd(bitmaps[0], NewBitmap()).IsEmpty())
+}
+
+func TestFastParOr(t *testing.T) {
+	var bitmaps []*Bitmap
+	m := make(map[uint64]struct{})
+	for i := 0; i < 6; i++ {
+		bm, bmm := randomBitmap(8)
+		// Some sparse keys spread further apart.
+		for j := 0; j < 20; j++ {
+			x := uint64(rand.Intn(64)) << 16
+			bm.Set(x)
+			bmm[x] = struct{}{}
+		}
+		// Short runs, and a bitmap container left with few elements, whose
+		// unions fit in arrays.
+		lo := uint64(64<<16 + rand.Intn(1000))
+		bm.SetRange(lo, lo+100)
+		for x := lo; x < lo+100; x++ {
+			bmm[x] = struct{}{}
+		}
+		for x := uint64(65 << 16); x < 65<<16+10000; x += 2 {
+			bm.Set(x)
+		}
+		for x := uint64(65 << 16); x < 65<<16+10000; x += 2 {
+			if rand.Intn(100) > 0 {
+				bm.Remove(x)
+			} else {
+				bmm[x] = struct{}{}
+			}
+		}
+		types := make(map[uint16]bool)
+		for k := 64; k < 66; k++ {
+			offset, has := bm.keys.getValue(uint64(k) << 16)
+			require.True(t, has)
+			types[bm.getContainer(offset)[indexType]] = true
+		}
+		require.Equal(t, map[uint16]bool{typeRun: true, typeBitmap: true}, types)
+		bitmaps = append(bitmaps, bm)
+		for x := range bmm {
+			m[x] = struct{}{}
+		}
+	}
+	has := func(x uint64) bool {
+		_, ok := m[x]
+		return ok
+	}
+	for _, numGo := range []int{1, 2, 3, 8, 100} {
+		res := FastParOr(numGo, bitmaps...)
+		requireElements(t, res, 66<<16, has)
+		require.True(t, Equals(FastOr(bitmaps...), res))
+
+		// The result should allow modifications.
+		res.Set(100 << 16)
+		res.SetRange(0, 1<<10)
+		requireElements(t, res, 101<<16, func(x uint64) bool {
+			return has(x) || x == 100<<16 || x < 1<<10
+		})
+	}
+	require.True(t, FastParOr(4).IsEmpty())
+	require.True(t, FastParOr(4, NewBitmap(), NewBitmap()).IsEmpty())
+}
+
+func TestFastAndNot(t *testing.T) {
+	base, bm := randomBitmap(8)
+	base.SetRange(2<<16, 4<<16)
+	for x := uint64(2 << 16); x < 4<<16; x++ {
+		bm[x] = struct{}{}
+	}
+	clone := base.Clone()
+
+	var others []*Bitmap
+	var oms []map[uint64]struct{}
+	for i := 0; i < 3; i++ {
+		o, om := randomBitmap(8)
+		others = append(others, o)
+		oms = append(oms, om)
+	}
+	fn := func(x uint64) bool {
+		if _, ok := bm[x]; !ok {
+			return false
+		}
+		for _, om := range oms {
+			if _, ok := om[x]; ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	res := FastAndNot(base, others...)
+	requireElements(t, res, 8<<16, fn)
+	require.Equal(t, clone.ToBuffer(), base.ToBuffer())
+
+	// The result matches calling AndNot repeatedly, but has no slack.
+	exp := base.Clone()
+	for _, o := range others {
+		exp.AndNot(o)
+	}
+	require.True(t, Equals(exp, res))
+	for i := 0; i < res.keys.numKeys(); i++ {
+		// Skip the empty container for key 0, which every bitmap has.
+		if c := res.getContainer(res.keys.val(i)); getCardinality(c) > 0 {
+			sz, typ := minimalSize(c)
+			require.Equal(t, sz, len(c))
+			require.Equal(t, typ, c[indexType])
+		}
+	}
+
+	requireElements(t, FastAndNot(base, others[0]), 8<<16, func(x uint64) bool {
+		_, ok := oms[0][x]
+		_, has := bm[x]
+		return has && !ok
+	})
+	require.True(t, Equals(base, FastAndNot(base)))
+	require.True(t, Equals(base, FastAndNot(base, nil, NewBitmap())))
+	require.True(t, FastAndNot(base, base).IsEmpty())
+	require.True(t, FastAndNot(nil, base).IsEmpty())
+}
+
+func TestCompact(t *testing.T) {
+	a, am := randomBitmap(8)
+	// A bitmap container with few elements, which is smaller as an array.
+	for x := uint64(0); x < 5000; x++ {
+		a.Set(20<<16 + 13*x)
+		am[20<<16+13*x] = struct{}{}
+	}
+	for x := uint64(0); x < 4000; x++ {
+		a.Remove(20<<16 + 13*x)
+		delete(am, 20<<16+13*x)
+	}
+	// A bitmap container with a dense range, which is smaller as runs.
+	for x := uint64(0); x < 10000; x++ {
+		a.Set(21<<16 + 3*x)
+	}
+	for x := uint64(0); x < 10000; x++ {
+		a.Remove(21<<16 + 3*x)
+	}
+	a.SetRange(21<<16+100, 21<<16+20000)
+	for x := uint64(21<<16 + 100); x < 21<<16+20000; x++ {
+		am[x] = struct{}{}
+	}
+	// A run container with many short runs, which is smaller as an array.
+	a.SetRange(22<<16, 22<<16+1000)
+	for x := uint64(22 << 16); x < 22<<16+1000; x++ {
+		if x%2 == 0 {
+			a.Remove(x)
+		} else {
+			am[x] = struct{}{}
+		}
+	}
+	// Orphaned containers, and empty ones.
+	a.And(a.Clone())
+	a.RemoveRange(5<<16, 7<<16)
+	for x := uint64(5 << 16); x < 7<<16; x++ {
+		delete(am, x)
+	}
+	a.Set(30 << 16)
+	a.Remove(30 << 16)
+
+	fn := func(x uint64) bool {
+		_, ok := am[x]
+		return ok
+	}
+	before := len(a.data)
+	a.Compact()
+	require.Less(t, len(a.data), before)
+	requireElements(t, a, 32<<16, fn)
+	require.NoError(t, validate(a.data))
+
+	for i := 0; i < a.keys.numKeys(); i++ {
+		c := a.getContainer(a.keys.val(i))
+		require.True(t, i == 0 || getCardinality(c) > 0)
+		sz, typ := minimalSize(c)
+		require.Equal(t, sz, len(c))
+		require.Equal(t, typ, c[indexType])
+	}
+
+	// Bitmaps with the same elements compact to the same buffer.
+	b := FromSortedList(a.ToArray())
+	b.Compact()
+	require.Equal(t, a.ToBuffer(), b.ToBuffer())
+	a.Compact()
+	require.Equal(t, a.ToBuffer(), b.ToBuffer())
+
+	// A compacted bitmap can still be modified.
+	c := FromBuffer(a.ToBufferWithCopy())
+	c.Compact()
+	for x := uint64(0); x < 100; x++ {
+		c.Set(40<<16 + x)
+		c.Set(20<<16 + x)
+		c.Remove(21<<16 + 200 + x)
+		am[40<<16+x] = struct{}{}
+		am[20<<16+x] = struct{}{}
+		delete(am, 21<<16+200+x)
+	}
+	requireElements(t, c, 42<<16, fn)
+
+	empty := NewBitmap()
+	empty.Compact()
+	require.True(t, empty.IsEmpty())
+	empty.Set(10)
+	require.Equal(t, []uint64{10}, empty.ToArray())
+}
@@ -28,10 +28,15 @@ import (
 // The container size cannot exceed the vicinity of 8KB. At 8KB, we switch from packed arrays to
 // bitmaps. We can fit the entire uint16 worth of bitmaps in 8KB (2^16 / 8 = 8
 // KB).
+//
+// Dense ranges of consecutive integers are stored in run containers. A run container stores the
+// number of runs right after the header, followed by the runs as (start, last) pairs. Both start
+// and last are inclusive, so a single run can cover the entire uint16 range.
 
 const (
 	typeArray  uint16 = 0x00
 	typeBitmap uint16 = 0x01
+	typeRun    uint16 = 0x02
 
 	// Container header.
 	indexSize        int = 0
@@ -84,6 +89,8 @@ func zeroOutContainer(c []uint16) {
 		array(c).zeroOut()
 	case typeBitmap:
 		bitmap(c).zeroOut()
+	case typeRun:
+		run(c).zeroOut()
 	}
 }
 
@@ -93,9 +100,186 @@ func removeRangeContainer(c []uint16, lo, hi uint16) {
 		array(c).removeRange(lo, hi)
 	case typeBitmap:
 		bitmap(c).removeRange(lo, hi)
+	case typeRun:
+		run(c).removeRange(lo, hi)
 	}
 }
 
+// containerToBitmap converts the given array or run container to a bitmap container. If buf is
+// empty, a new container is allocated.
+func containerToBitmap(c, buf []uint16) []uint16 {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).toBitmapContainer(buf)
+	case typeRun:
+		return run(c).toBitmapContainer(buf)
+	}
+	panic("containerToBitmap: We should not reach here")
+}
+
+// compactSize returns the smallest size the container can be stored in, without changing its type.
+func compactSize(c []uint16) int {
+	switch c[indexType] {
+	case typeArray:
+		// Keep the spare slot at the end.
+		return int(startIdx) + getCardinality(c) + 1
+	case typeBitmap:
+		return maxContainerSize
+	case typeRun:
+		return runSize(run(c).numRuns())
+	}
+	panic("compactSize: We should not reach here")
+}
+
+// containerNumRuns returns the number of runs of consecutive elements in the container.
+func containerNumRuns(c []uint16) int {
+	switch c[indexType] {
+	case typeArray:
+		return numRuns(array(c).all())
+	case typeBitmap:
+		// A run starts at every set bit, whose previous bit isn't set. The bits are stored with the
+		// most significant bit first. So, the previous bit of the first bit in a word is the least
+		// significant bit of the previous word.
+		var n int
+		var prev uint16
+		for _, w := range c[startIdx:] {
+			n += bits.OnesCount16(w &^ (w>>1 | prev<<15))
+			prev = w & 1
+		}
+		return n
+	case typeRun:
+		return run(c).numRuns()
+	}
+	panic("containerNumRuns: We should not reach here")
+}
+
+// minimalSize returns the smallest size the container can be stored in, along with the type of
+// container to use for it. If the sizes are equal, an array is preferred over a run container,
+// which is preferred over a bitmap container. So, the result only depends on the elements of the
+// container, and not on its current type.
+func minimalSize(c []uint16) (int, uint16) {
+	sz, typ := maxContainerSize, uint16(typeBitmap)
+	if n := containerNumRuns(c); fitsRun(n) && runSize(n) <= sz {
+		sz, typ = runSize(n), typeRun
+	}
+	// Keep the spare slot at the end of the array.
+	if card := getCardinality(c); card < 4096 && int(startIdx)+card+1 <= sz {
+		sz, typ = int(startIdx)+card+1, typeArray
+	}
+	return sz, typ
+}
+
+// minimalContainer writes the container c to buf, converted to the type returned by minimalSize.
+// buf must be zeroed, and at least as long as the size returned by minimalSize. It returns the
+// container written to buf. c is not modified.
+func minimalContainer(c, buf []uint16) []uint16 {
+	sz, typ := minimalSize(c)
+	out := buf[:sz]
+	if c[indexType] == typ {
+		copy(out, c)
+		out[indexSize] = uint16(sz)
+		return out
+	}
+
+	switch typ {
+	case typeArray:
+		if c[indexType] == typeBitmap {
+			return bitmap(c).toArrayContainer(out)
+		}
+		out[indexSize] = uint16(sz)
+		out[indexType] = typeArray
+		setCardinality(out, getCardinality(c))
+		copy(out[startIdx:], run(c).all())
+		return out
+
+	case typeBitmap:
+		if c[indexType] == typeArray {
+			return array(c).toBitmapContainer(out)
+		}
+		return run(c).toBitmapContainer(out)
+
+	case typeRun:
+		r := run(out)
+		runs := r[runOffset(0):]
+		var n int
+		if c[indexType] == typeArray {
+			for _, x := range array(c).all() {
+				n = appendRun(runs, n, x, x)
+			}
+		} else {
+			for idx, w := range c[startIdx:] {
+				for w > 0 {
+					// Take the leading ones, starting at the first set bit.
+					pos := bits.LeadingZeros16(w)
+					ones := bits.LeadingZeros16(^(w << pos))
+					start := uint16(idx<<4 | pos)
+					n = appendRun(runs, n, start, start+uint16(ones)-1)
+					w &^= 0xFFFF>>pos &^ (0xFFFF >> (pos + ones))
+				}
+			}
+		}
+		r[indexSize] = uint16(sz)
+		r[indexType] = typeRun
+		r.setNumRuns(n)
+		setCardinality(r, getCardinality(c))
+		return r
+	}
+	panic("minimalContainer: We should not reach here")
+}
+
+// containerHas returns true if x is present in the container.
+func containerHas(c []uint16, x uint16) bool {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).has(x)
+	case typeBitmap:
+		return bitmap(c).has(x)
+	case typeRun:
+		return run(c).has(x)
+	}
+	panic("containerHas: We should not reach here")
+}
+
+// containerSelect returns the element at index idx in the container.
+func containerSelect(c []uint16, idx int) uint16 {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).all()[idx]
+	case typeBitmap:
+		return bitmap(c).selectAt(idx)
+	case typeRun:
+		return run(c).selectAt(idx)
+	}
+	panic("containerSelect: We should not reach here")
+}
+
+// containerCountUpTo returns the number of elements <= x in the container.
+func containerCountUpTo(c []uint16, x uint16) int {
+	switch c[indexType] {
+	case typeArray:
+		a := array(c)
+		i := a.find(x)
+		if i < getCardinality(c) && a[int(startIdx)+i] == x {
+			i++
+		}
+		return i
+	case typeBitmap:
+		return bitmap(c).cardinalityInRange(0, x)
+	case typeRun:
+		r := run(c)
+		var num int
+		for i := 0; i < r.numRuns() && r.start(i) <= x; i++ {
+			last := r.last(i)
+			if last > x {
+				last = x
+			}
+			num += int(last-r.start(i)) + 1
+		}
+		return num
+	}
+	panic("containerCountUpTo: We should not reach here")
+}
+
 func calculateAndSetCardinality(data []uint16) {
 	if data[indexType] != typeBitmap {
 		panic("Non-bitmap containers should always have cardinality set correctly")
@@ -107,50 +291,54 @@ func calculateAndSetCardinality(data []uint16) {
 
 type array []uint16
 
-// find returns the index of the first element >= x.
-// The index is based on data portion of the container, ignoring startIdx.
-// If the element > than all elements present, then N is returned where N = cardinality of the
-// container.
+// find returns the index of the first element >= x. The index is based on the data portion of the
+// container, ignoring startIdx. If x is greater than all the elements, then N is returned where
+// N = number of elements in the container.
 func (c array) find(x uint16) int {
+	idx, _ := c.search(x)
+	return idx
+}
+
+// search returns the index of the first element >= x, like find, and whether that element is x.
+func (c array) search(x uint16) (int, bool) {
 	N := getCardinality(c)
-	for i := int(startIdx); i < int(startIdx)+N; i++ {
-		if len(c) <= int(i) {
-			panic(fmt.Sprintf("find: %d len(c) %d <= i %d\n", x, len(c), i))
-		}
-		if c[i] >= x {
-			return int(i - int(startIdx))
-		}
+	data := c[startIdx : int(startIdx)+N]
+	// Elements are mostly added in increasing order. So, check the last one before searching.
+	if N == 0 || data[N-1] < x {
+		return N, false
+	}
+	idx := binarySearch(data, x)
+	if idx < 0 {
+		// x is missing. binarySearch encodes the index where it would be inserted.
+		return -idx - 1, false
 	}
-	return N
+	return idx, true
 }
 
+// rank returns the number of elements < x, if x is present in the container. Otherwise, it
+// returns -1, even if x lies between the elements. This is the same as for the bitmap and run
+// containers, so that Bitmap.Rank doesn't depend on the type of the container.
 func (c array) rank(x uint16) int {
-	N := getCardinality(c)
-	idx := c.find(x)
-	if idx == N {
+	idx, has := c.search(x)
+	if !has {
 		return -1
 	}
 	return idx
 }
 
 func (c array) has(x uint16) bool {
-	N := getCardinality(c)
-	idx := c.find(x)
-	if idx == N {
-		return false
-	}
-	return c[int(startIdx)+idx] == x
+	_, has := c.search(x)
+	return has
 }
 
 func (c array) add(x uint16) bool {
-	idx := c.find(x)
+	idx, has := c.search(x)
+	if has {
+		return false
+	}
 	N := getCardinality(c)
 	offset := int(startIdx) + idx
-
-	if int(idx) < N {
-		if c[offset] == x {
-			return false
-		}
+	if idx < N {
 		// The entry at offset is the first entry, which is greater than x. Move it to the right.
 		copy(c[offset+1:], c[offset:])
 	}
@@ -160,31 +348,27 @@ func (c array) add(x uint16) bool {
 }
 
 func (c array) remove(x uint16) bool {
-	idx := c.find(x)
+	idx, has := c.search(x)
+	if !has {
+		return false
+	}
 	N := getCardinality(c)
 	offset := int(startIdx) + idx
-
-	if int(idx) < N {
-		if c[offset] != x {
-			return false
-		}
-		copy(c[offset:], c[offset+1:])
-		setCardinality(c, N-1)
-		return true
-	}
-	return false
+	copy(c[offset:], c[offset+1:])
+	setCardinality(c, N-1)
+	return true
 }
 
 func (c array) removeRange(lo, hi uint16) {
 	if hi < lo {
 		panic(fmt.Sprintf("args must satisfy lo <= hi, got lo: %d, hi: %d\n", lo, hi))
 	}
-	loIdx := c.find(lo)
-	hiIdx := c.find(hi)
-
 	st := int(startIdx)
-	loVal := c[st+loIdx]
 	N := getCardinality(c)
+	loIdx := c.find(lo)
+	// hi is usually close to lo. So, gallop from lo, instead of searching the whole array.
+	hiIdx := advanceUntil(c[st:st+N], loIdx-1, N, hi)
+	loVal := c[st+loIdx]
 
 	// remove range doesn't intersect with any element in the array.
 	if hi < loVal || loIdx == N {
@@ -269,6 +453,26 @@ func (c array) orArray(other array, buf []uint16, runMode int) []uint16 {
 	return out
 }
 
+func (c array) xorArray(other array, buf []uint16, runMode int) []uint16 {
+	// We ignore runInline for this call.
+
+	max := getCardinality(c) + getCardinality(other)
+	if max >= 4096 {
+		// Use bitmap container.
+		out := bitmap(c.toBitmapContainer(buf))
+		out.xorArray(other, nil, runMode|runInline)
+		return out
+	}
+
+	// The output would be of typeArray. Ensure we have at least one empty slot at the end.
+	num := exclusiveUnion2by2(c.all(), other.all(), buf[startIdx:])
+	out := buf[:int(startIdx)+num+1]
+	out[indexType] = typeArray
+	out[indexSize] = uint16(len(out))
+	setCardinality(out, num)
+	return out
+}
+
 var tmp = make([]uint16, 8192)
 
 func (c array) andBitmap(other bitmap) []uint16 {
@@ -299,6 +503,9 @@ func (c array) andNotBitmap(other bitmap, buf []uint16) []uint16 {
 			res.add(e)
 		}
 	}
+	// Ensure we have at least one empty slot at the end.
+	res = res[:int(startIdx)+getCardinality(res)+1]
+	res[indexSize] = uint16(len(res))
 	return res
 }
 
@@ -350,6 +557,55 @@ func (c array) toBitmapContainer(buf []uint16) []uint16 {
 	return b
 }
 
+// andNotRun returns the elements of the array container which are not present in the run
+// container.
+func (c array) andNotRun(other run) []uint16 {
+	out := make([]uint16, int(startIdx)+getCardinality(c)+1)
+	N := other.numRuns()
+
+	var pos, ri int
+	for _, x := range c.all() {
+		for ri < N && other.last(ri) < x {
+			ri++
+		}
+		if ri < N && other.start(ri) <= x {
+			continue
+		}
+		out[int(startIdx)+pos] = x
+		pos++
+	}
+
+	// Ensure we have at least one empty slot at the end.
+	out = out[:int(startIdx)+pos+1]
+	out[indexType] = typeArray
+	out[indexSize] = uint16(len(out))
+	setCardinality(out, pos)
+	return out
+}
+
+// runOptimize converts the array container to a run container in place, if the run encoding takes
+// at most half the size of the container. This leaves enough space in the container for the runs
+// to grow. It returns true if the container was converted.
+func (c array) runOptimize() bool {
+	vals := c.all()
+	n := numRuns(vals)
+	if 2*runSize(n) > len(c) {
+		return false
+	}
+	runs := make([]uint16, 2*n)
+	var m int
+	for _, x := range vals {
+		m = appendRun(runs, m, x, x)
+	}
+	assert(m == n)
+
+	r := run(c)
+	copy(r[runOffset(0):], runs)
+	r.setNumRuns(n)
+	r[indexType] = typeRun
+	return true
+}
+
 func (c array) String() string {
 	var b strings.Builder
 	b.WriteString(fmt.Sprintf("Size: %d\n", c[0]))
@@ -442,23 +698,43 @@ func (b bitmap) has(x uint16) bool {
 	return has > 0
 }
 
+// word returns the ith 64-bit word of the bitmap, which holds the elements in [64i, 64i+64). Like
+// in the 16-bit words, the elements are stored with the most significant bit first.
+func (b bitmap) word(i int) uint64 {
+	j := int(startIdx) + 4*i
+	return toWord(b[j : j+4 : j+4])
+}
+
+// toWord packs the four 16-bit words of w into a 64-bit word, the first one being the most
+// significant.
+func toWord(w []uint16) uint64 {
+	return uint64(w[0])<<48 | uint64(w[1])<<32 | uint64(w[2])<<16 | uint64(w[3])
+}
+
+// popcount returns the number of set bits in data. Its length must be a multiple of 4.
+func popcount(data []uint16) int {
+	var num int
+	for i := 0; i+4 <= len(data); i += 4 {
+		num += bits.OnesCount64(toWord(data[i : i+4 : i+4]))
+	}
+	return num
+}
+
 func (b bitmap) rank(x uint16) int {
-	idx := x >> 4
-	pos := x & 0xF
-	if b[startIdx+idx]&bitmapMask[pos] == 0 {
+	if !b.has(x) {
 		return -1
 	}
+	return b.countBefore(x)
+}
 
-	var rank int
-	for i := 0; i < int(idx); i++ {
-		rank += bits.OnesCount16(b[int(startIdx)+i])
-	}
-	for p := uint16(0); p <= pos; p++ {
-		if b[startIdx+idx]&bitmapMask[p] > 0 {
-			rank++
-		}
-	}
-	return rank - 1
+// countBefore returns the number of elements < x, whether x is present or not.
+func (b bitmap) countBefore(x uint16) int {
+	// Count the elements in the 64-bit words before x, and then the ones < x in its word. For the
+	// first element of a word, the shift by 64 leaves nothing.
+	i := int(x >> 6)
+	num := popcount(b[startIdx : int(startIdx)+4*i])
+	num += bits.OnesCount64(b.word(i) >> (64 - x&63))
+	return num
 }
 
 // TODO: This can perhaps be using SIMD instructions.
@@ -570,6 +846,96 @@ func (b bitmap) orArray(other array, buf []uint16, runMode int) []uint16 {
 	return buf
 }
 
+func (b bitmap) xorBitmap(other bitmap, buf []uint16, runMode int) []uint16 {
+	if runMode&runInline > 0 {
+		buf = b
+	} else {
+		copy(buf, b) // Copy over first.
+	}
+	buf[indexSize] = maxContainerSize
+	buf[indexType] = typeBitmap
+
+	data := buf[startIdx:]
+	if runMode&runLazy > 0 {
+		for i, v := range other[startIdx:] {
+			data[i] ^= v
+		}
+		setCardinality(buf, invalidCardinality)
+
+	} else {
+		var num int
+		for i, v := range other[startIdx:] {
+			data[i] ^= v
+			num += bits.OnesCount16(data[i])
+		}
+		setCardinality(buf, num)
+	}
+	if runMode&runInline > 0 {
+		return nil
+	}
+	return buf
+}
+
+func (b bitmap) xorArray(other array, buf []uint16, runMode int) []uint16 {
+	if runMode&runInline > 0 {
+		buf = b
+	} else {
+		copy(buf, b)
+	}
+
+	if num := getCardinality(b); runMode&runLazy > 0 || num == invalidCardinality {
+		// Avoid calculating the cardinality to speed up operations.
+		for _, x := range other.all() {
+			buf[startIdx+x>>4] ^= bitmapMask[x&0xF]
+		}
+		setCardinality(buf, invalidCardinality)
+
+	} else {
+		for _, x := range other.all() {
+			val := &buf[startIdx+x>>4]
+			*val ^= bitmapMask[x&0xF]
+			if *val&bitmapMask[x&0xF] > 0 {
+				num++
+			} else {
+				num--
+			}
+		}
+		setCardinality(buf, num)
+	}
+
+	if runMode&runInline > 0 {
+		return nil
+	}
+	return buf
+}
+
+func (b bitmap) xorRun(other run, buf []uint16, runMode int) []uint16 {
+	if runMode&runInline > 0 {
+		buf = b
+	} else {
+		copy(buf, b)
+	}
+	out := bitmap(buf)
+
+	if num := getCardinality(b); runMode&runLazy > 0 || num == invalidCardinality {
+		for i := 0; i < other.numRuns(); i++ {
+			out.flipRange(other.start(i), other.last(i))
+		}
+		setCardinality(buf, invalidCardinality)
+
+	} else {
+		for i := 0; i < other.numRuns(); i++ {
+			num += out.flipRange(other.start(i), other.last(i))
+		}
+		setCardinality(buf, num)
+	}
+
+	if runMode&runInline > 0 {
+		return nil
+	}
+	return buf
+}
+
 func (b bitmap) all() []uint16 {
 	var res []uint16
 	data := b[startIdx:]
@@ -585,29 +951,70 @@ func (b bitmap) all() []uint16 {
 	return res
 }
 
-//TODO: It can be optimized.
+// toArrayContainer converts the bitmap container into an array container. The bitmap must have
+// its cardinality set, and it must be less than 4096, so the array fits within a container.
+func (b bitmap) toArrayContainer(buf []uint16) []uint16 {
+	card := getCardinality(b)
+	assert(card < 4096)
+	sz := int(startIdx) + card + 1
+	if len(buf) < sz {
+		buf = make([]uint16, sz)
+	}
+	out := buf[:sz]
+	out[indexSize] = uint16(sz)
+	out[indexType] = typeArray
+	setCardinality(out, card)
+
+	i := int(startIdx)
+	for idx, x := range b[startIdx:] {
+		for x > 0 {
+			pos := bits.LeadingZeros16(x)
+			out[i] = uint16(idx<<4 | pos)
+			i++
+			x &^= bitmapMask[pos]
+		}
+	}
+	out[i] = 0
+	return out
+}
+
 func (b bitmap) selectAt(idx int) uint16 {
 	data := b[startIdx:]
-	n := uint16(len(data))
-	for i := uint16(0); i < n; i++ {
-		x := data[i]
-		c := bits.OnesCount16(x)
+	for i := 0; i+4 <= len(data); i += 4 {
+		w := toWord(data[i : i+4 : i+4])
+		c := bits.OnesCount64(w)
 		if idx < c {
-			for pos := uint16(0); pos < 16; pos++ {
-				if idx == 0 && x&bitmapMask[pos] > 0 {
-					return i*16 + pos
-				}
-				if x&bitmapMask[pos] > 0 {
-					idx--
-				}
-			}
-
+			// The elements are stored with the most significant bit first. So, the element at idx
+			// is the set bit at c-1-idx, counting from the least significant bit.
+			return uint16(16*i + 63 - select64(w, c-1-idx))
 		}
 		idx -= c
 	}
 	panic("should not reach here")
 }
 
+// select64 returns the position of the set bit at index k in w, counting from the least
+// significant bit. w must have more than k set bits.
+func select64(w uint64, k int) int {
+	const ones, highs = 0x0101010101010101, 0x8080808080808080
+	// Count the set bits of each byte, and then sum them up, so that byte i holds the number of
+	// set bits in the bytes [0, i].
+	s := w - (w>>1)&0x5555555555555555
+	s = s&0x3333333333333333 + (s>>2)&0x3333333333333333
+	s = (s + s>>4) & 0x0F0F0F0F0F0F0F0F
+	s *= ones
+	// The high bit of each byte is set if its sum is <= k. So, the number of such bytes is the
+	// index of the byte holding the bit.
+	byteIdx := bits.OnesCount64(((uint64(k)*ones | highs) - s) & highs)
+	// Skip the set bits of the bytes before, and then of the byte holding the bit.
+	k -= int((s << 8 >> (8 * byteIdx)) & 0xFF)
+	x := uint8(w >> (8 * byteIdx))
+	for ; k > 0; k-- {
+		x &= x - 1
+	}
+	return 8*byteIdx + bits.TrailingZeros8(x)
+}
+
 // bitValue returns a 0 or a 1 depending upon whether x is present in the bitmap, where 1 means
 // present and 0 means absent.
 func (b bitmap) bitValue(x uint16) uint16 {
@@ -651,11 +1058,7 @@ func (b bitmap) maximum() uint16 {
 }
 
 func (b bitmap) cardinality() int {
-	var num int
-	for _, x := range b[startIdx:] {
-		num += bits.OnesCount16(x)
-	}
-	return num
+	return popcount(b[startIdx:])
 }
 
 var zeroContainer = make([]uint16, maxContainerSize)
@@ -665,33 +1068,630 @@ func (b bitmap) zeroOut() {
 	copy(b[startIdx:], zeroContainer[startIdx:])
 }
 
-var (
-	runInline = 0x01
-	runLazy   = 0x02
-)
-
-func containerOr(ac, bc, buf []uint16, runMode int) []uint16 {
-	at := ac[indexType]
-	bt := bc[indexType]
-
-	if at == typeArray && bt == typeArray {
-		left := array(ac)
-		right := array(bc)
-		// We can't always inline this function. If the right container has
-		// enough entries, trying to do a union with the left container inplace
-		// could end up overwriting the left container entries. So, we use a
-		// buffer to hold all output, and then copy it over to left.
-		//
-		// TODO: If right doesn't have a lot of entries, we could just iterate
-		// over left and merge the entries from right inplace. Would be faster
-		// than copying over all entries into buffer. Worth trying that approach.
-		return left.orArray(right, buf, runMode)
+// wordMask returns the mask of the bits in the idx-th word of a bitmap container, which lie within
+// the range [lo, hi].
+func wordMask(idx, lo, hi uint16) uint16 {
+	m := uint16(0xFFFF)
+	if idx == lo>>4 {
+		m &= 0xFFFF >> (lo & 0xF)
 	}
-	if at == typeArray && bt == typeBitmap {
-		left := array(ac)
-		right := bitmap(bc)
-		// Don't run inline for this call.
-		return right.orArray(left, buf, runMode&^runInline)
+	if idx == hi>>4 {
+		m &= 0xFFFF << (15 - hi&0xF)
+	}
+	return m
+}
+
+// setRange sets all the bits in [lo, hi]. It returns the number of bits which were newly set. It
+// does not update the cardinality of the container.
+func (b bitmap) setRange(lo, hi uint16) int {
+	data := b[startIdx:]
+	var num int
+	for i := lo >> 4; i <= hi>>4; i++ {
+		m := wordMask(i, lo, hi)
+		num += bits.OnesCount16(m &^ data[i])
+		data[i] |= m
+	}
+	return num
+}
+
+// clearRange unsets all the bits in [lo, hi]. It returns the number of bits which were unset. It
+// does not update the cardinality of the container.
+func (b bitmap) clearRange(lo, hi uint16) int {
+	data := b[startIdx:]
+	var num int
+	for i := lo >> 4; i <= hi>>4; i++ {
+		m := wordMask(i, lo, hi)
+		num += bits.OnesCount16(m & data[i])
+		data[i] &^= m
+	}
+	return num
+}
+
+// flipRange flips all the bits in [lo, hi]. It returns the change in the number of set bits. It
+// does not update the cardinality of the container.
+func (b bitmap) flipRange(lo, hi uint16) int {
+	data := b[startIdx:]
+	var num int
+	for i := lo >> 4; i <= hi>>4; i++ {
+		m := wordMask(i, lo, hi)
+		num += bits.OnesCount16(m) - 2*bits.OnesCount16(m&data[i])
+		data[i] ^= m
+	}
+	return num
+}
+
+func (b bitmap) orRun(other run, buf []uint16, runMode int) []uint16 {
+	if runMode&runInline > 0 {
+		buf = b
+	} else {
+		copy(buf, b)
+	}
+	out := bitmap(buf)
+
+	if num := getCardinality(b); num == maxCardinality {
+		// do nothing. This bitmap is already full.
+
+	} else if runMode&runLazy > 0 || num == invalidCardinality {
+		for i := 0; i < other.numRuns(); i++ {
+			out.setRange(other.start(i), other.last(i))
+		}
+		setCardinality(buf, invalidCardinality)
+
+	} else {
+		for i := 0; i < other.numRuns(); i++ {
+			num += out.setRange(other.start(i), other.last(i))
+		}
+		setCardinality(buf, num)
+	}
+
+	if runMode&runInline > 0 {
+		return nil
+	}
+	return buf
+}
+
+func (b bitmap) andRun(other run) []uint16 {
+	out := make([]uint16, maxContainerSize)
+	out[indexSize] = maxContainerSize
+	out[indexType] = typeBitmap
+
+	var num int
+	for i := 0; i < other.numRuns(); i++ {
+		lo, hi := other.start(i), other.last(i)
+		for idx := lo >> 4; idx <= hi>>4; idx++ {
+			w := b[startIdx+idx] & wordMask(idx, lo, hi)
+			out[startIdx+idx] |= w
+			num += bits.OnesCount16(w)
+		}
+	}
+	setCardinality(out, num)
+	return out
+}
+
+func (b bitmap) andNotRun(other run) []uint16 {
+	num := getCardinality(b)
+	for i := 0; i < other.numRuns(); i++ {
+		num -= b.clearRange(other.start(i), other.last(i))
+	}
+	setCardinality(b, num)
+	return b
+}
+
+type run []uint16
+
+func runOffset(i int) int { return int(startIdx) + 1 + 2*i }
+
+// runSize returns the size of a run container with n runs, with space for one more run.
+func runSize(n int) int { return runOffset(n + 1) }
+
+// fitsRun returns true if n runs can be stored in a run container, which is smaller than a bitmap
+// container.
+func fitsRun(n int) bool { return runSize(n) < maxContainerSize }
+
+func (r run) numRuns() int       { return int(r[startIdx]) }
+func (r run) setNumRuns(n int)   { r[startIdx] = uint16(n) }
+func (r run) start(i int) uint16 { return r[runOffset(i)] }
+func (r run) last(i int) uint16  { return r[runOffset(i)+1] }
+func (r run) runs() []uint16     { return r[runOffset(0):runOffset(r.numRuns())] }
+
+func (r run) setRun(i int, start, last uint16) {
+	r[runOffset(i)] = start
+	r[runOffset(i)+1] = last
+}
+
+// isFull returns true if there's no space left in the container to add another run.
+func (r run) isFull() bool {
+	return runOffset(r.numRuns()+1) > len(r)
+}
+
+// find returns the index of the first run whose last element is >= x. If x is greater than all the
+// elements, then N is returned where N = number of runs in the container.
+func (r run) find(x uint16) int {
+	lo, hi := 0, r.numRuns()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if r.last(mid) < x {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func (r run) has(x uint16) bool {
+	i := r.find(x)
+	return i < r.numRuns() && r.start(i) <= x
+}
+
+func (r run) rank(x uint16) int {
+	i := r.find(x)
+	if i == r.numRuns() || r.start(i) > x {
+		return -1
+	}
+	var rank int
+	for j := 0; j < i; j++ {
+		rank += int(r.last(j)-r.start(j)) + 1
+	}
+	return rank + int(x-r.start(i))
+}
+
+func (r run) selectAt(idx int) uint16 {
+	for i := 0; i < r.numRuns(); i++ {
+		n := int(r.last(i)-r.start(i)) + 1
+		if idx < n {
+			return r.start(i) + uint16(idx)
+		}
+		idx -= n
+	}
+	panic("should not reach here")
+}
+
+// add adds x to the container. The container must have space for one more run.
+func (r run) add(x uint16) bool {
+	N := r.numRuns()
+	i := r.find(x)
+	if i < N && r.start(i) <= x {
+		return false
+	}
+
+	// x lies between the runs i-1 and i. See if it extends any of them.
+	extendPrev := i > 0 && r.last(i-1)+1 == x
+	extendNext := i < N && r.start(i)-1 == x
+	switch {
+	case extendPrev && extendNext:
+		// x fills up the gap between the two runs. Merge them.
+		r.setRun(i-1, r.start(i-1), r.last(i))
+		copy(r[runOffset(i):], r[runOffset(i+1):runOffset(N)])
+		r.setNumRuns(N - 1)
+	case extendPrev:
+		r.setRun(i-1, r.start(i-1), x)
+	case extendNext:
+		r.setRun(i, x, r.last(i))
+	default:
+		assert(!r.isFull())
+		copy(r[runOffset(i+1):runOffset(N+1)], r[runOffset(i):runOffset(N)])
+		r.setRun(i, x, x)
+		r.setNumRuns(N + 1)
+	}
+	incrCardinality(r)
+	return true
+}
+
+// remove removes x from the container. The container must have space for one more run, because
+// removing x from the middle of a run splits it into two.
+func (r run) remove(x uint16) bool {
+	N := r.numRuns()
+	i := r.find(x)
+	if i == N || r.start(i) > x {
+		return false
+	}
+
+	start, last := r.start(i), r.last(i)
+	switch {
+	case start == last:
+		copy(r[runOffset(i):], r[runOffset(i+1):runOffset(N)])
+		r.setNumRuns(N - 1)
+	case x == start:
+		r.setRun(i, x+1, last)
+	case x == last:
+		r.setRun(i, start, x-1)
+	default:
+		assert(!r.isFull())
+		copy(r[runOffset(i+1):runOffset(N+1)], r[runOffset(i):runOffset(N)])
+		r.setRun(i, start, x-1)
+		r.setRun(i+1, x+1, last)
+		r.setNumRuns(N + 1)
+	}
+	setCardinality(r, getCardinality(r)-1)
+	return true
+}
+
+// removeRange removes [lo, hi] from the container. Just like remove, the container must have space
+// for one more run.
+func (r run) removeRange(lo, hi uint16) {
+	if hi < lo {
+		panic(fmt.Sprintf("args must satisfy lo <= hi, got lo: %d, hi: %d\n", lo, hi))
+	}
+	N := r.numRuns()
+	// Runs in [i, j) overlap with [lo, hi].
+	i := r.find(lo)
+	j := r.find(hi)
+	if j < N && r.start(j) <= hi {
+		j++
+	}
+	if i >= j {
+		return
+	}
+
+	// Only the first and the last overlapping runs can have elements outside of [lo, hi].
+	var keep [4]uint16
+	var k int
+	if r.start(i) < lo {
+		keep[2*k], keep[2*k+1] = r.start(i), lo-1
+		k++
+	}
+	if r.last(j-1) > hi {
+		keep[2*k], keep[2*k+1] = hi+1, r.last(j-1)
+		k++
+	}
+	if k > j-i {
+		assert(!r.isFull())
+	}
+
+	var removed int
+	for x := i; x < j; x++ {
+		removed += int(r.last(x)-r.start(x)) + 1
+	}
+	for x := 0; x < k; x++ {
+		removed -= int(keep[2*x+1]-keep[2*x]) + 1
+	}
+
+	copy(r[runOffset(i+k):], r[runOffset(j):runOffset(N)])
+	copy(r[runOffset(i):], keep[:2*k])
+	r.setNumRuns(N - (j - i) + k)
+	setCardinality(r, getCardinality(r)-removed)
+}
+
+func (r run) zeroOut() {
+	r.setNumRuns(0)
+	setCardinality(r, 0)
+}
+
+func (r run) all() []uint16 {
+	res := make([]uint16, 0, getCardinality(r))
+	for i := 0; i < r.numRuns(); i++ {
+		for x := uint32(r.start(i)); x <= uint32(r.last(i)); x++ {
+			res = append(res, uint16(x))
+		}
+	}
+	return res
+}
+
+func (r run) minimum() uint16 {
+	if r.numRuns() == 0 {
+		return 0
+	}
+	return r.start(0)
+}
+
+func (r run) maximum() uint16 {
+	N := r.numRuns()
+	if N == 0 {
+		return 0
+	}
+	return r.last(N - 1)
+}
+
+func (r run) cardinality() int {
+	var num int
+	for i := 0; i < r.numRuns(); i++ {
+		num += int(r.last(i)-r.start(i)) + 1
+	}
+	return num
+}
+
+func (r run) toBitmapContainer(buf []uint16) []uint16 {
+	if len(buf) == 0 {
+		buf = make([]uint16, maxContainerSize)
+	} else {
+		assert(len(buf) == maxContainerSize)
+		assert(len(buf) == copy(buf, empty))
+	}
+
+	b := bitmap(buf)
+	b[indexSize] = maxContainerSize
+	b[indexType] = typeBitmap
+	for i := 0; i < r.numRuns(); i++ {
+		b.setRange(r.start(i), r.last(i))
+	}
+	setCardinality(b, getCardinality(r))
+	return b
+}
+
+func (r run) orRun(other run, buf []uint16) []uint16 {
+	if !fitsRun(r.numRuns() + other.numRuns()) {
+		out := bitmap(r.toBitmapContainer(buf))
+		out.orRun(other, nil, runInline)
+		return out
+	}
+	n := unionRuns(r.runs(), other.runs(), buf[runOffset(0):])
+	return runContainer(buf, n)
+}
+
+func (r run) orArray(other array, buf []uint16) []uint16 {
+	if !fitsRun(r.numRuns() + getCardinality(other)) {
+		out := bitmap(r.toBitmapContainer(buf))
+		out.orArray(other, nil, runInline)
+		return out
+	}
+	n := unionRuns(r.runs(), arrayRuns(other.all()), buf[runOffset(0):])
+	return runContainer(buf, n)
+}
+
+func (r run) andRun(other run) []uint16 {
+	out := make([]uint16, runSize(r.numRuns()+other.numRuns()))
+	n := intersectRuns(r.runs(), other.runs(), out[runOffset(0):])
+	return runContainer(out, n)
+}
+
+func (r run) andArray(other array) []uint16 {
+	out := make([]uint16, int(startIdx)+getCardinality(other)+1)
+	N := r.numRuns()
+
+	var pos, ri int
+	for _, x := range other.all() {
+		for ri < N && r.last(ri) < x {
+			ri++
+		}
+		if ri == N {
+			break
+		}
+		if r.start(ri) <= x {
+			out[int(startIdx)+pos] = x
+			pos++
+		}
+	}
+
+	// Ensure we have at least one empty slot at the end.
+	out = out[:int(startIdx)+pos+1]
+	out[indexType] = typeArray
+	out[indexSize] = uint16(len(out))
+	setCardinality(out, pos)
+	return out
+}
+
+func (r run) andNotRun(other run) []uint16 {
+	out := make([]uint16, runSize(r.numRuns()+other.numRuns()))
+	n := differenceRuns(r.runs(), other.runs(), out[runOffset(0):])
+	return runContainer(out, n)
+}
+
+func (r run) andNotArray(other array) []uint16 {
+	if !fitsRun(r.numRuns() + getCardinality(other)) {
+		out := bitmap(r.toBitmapContainer(nil))
+		return out.andNotArray(other)
+	}
+	out := make([]uint16, runSize(r.numRuns()+getCardinality(other)))
+	n := differenceRuns(r.runs(), arrayRuns(other.all()), out[runOffset(0):])
+	return runContainer(out, n)
+}
+
+func (r run) andNotBitmap(other bitmap, buf []uint16) []uint16 {
+	out := bitmap(r.toBitmapContainer(buf))
+	return out.andNotBitmap(other)
+}
+
+func (r run) xorRun(other run, buf []uint16) []uint16 {
+	if !fitsRun(r.numRuns() + other.numRuns()) {
+		out := bitmap(r.toBitmapContainer(buf))
+		out.xorRun(other, nil, runInline)
+		return out
+	}
+	n := xorRuns(r.runs(), other.runs(), buf[runOffset(0):])
+	return runContainer(buf, n)
+}
+
+func (r run) xorArray(other array, buf []uint16) []uint16 {
+	if !fitsRun(r.numRuns() + getCardinality(other)) {
+		out := bitmap(r.toBitmapContainer(buf))
+		out.xorArray(other, nil, runInline)
+		return out
+	}
+	n := xorRuns(r.runs(), arrayRuns(other.all()), buf[runOffset(0):])
+	return runContainer(buf, n)
+}
+
+// runContainer turns buf into a run container holding the n runs, which are already written to buf
+// starting at runOffset(0). If the runs don't fit in a run container, it returns a bitmap container
+// instead.
+func runContainer(buf []uint16, n int) []uint16 {
+	r := run(buf)
+	r[indexType] = typeRun
+	r.setNumRuns(n)
+	setCardinality(r, r.cardinality())
+	if !fitsRun(n) {
+		return r.toBitmapContainer(nil)
+	}
+	sz := runSize(n)
+	r = r[:sz]
+	r[indexSize] = uint16(sz)
+	return r
+}
+
+// rangeContainer returns a run container holding all the elements in [lo, hi].
+func rangeContainer(lo, hi uint16) []uint16 {
+	sz := runSize(1)
+	r := run(make([]uint16, sz))
+	r[indexSize] = uint16(sz)
+	r[indexType] = typeRun
+	r.setRun(0, lo, hi)
+	r.setNumRuns(1)
+	setCardinality(r, int(hi-lo)+1)
+	return r
+}
+
+// numRuns returns the number of runs in the given sorted set.
+func numRuns(set []uint16) int {
+	var n int
+	for i, x := range set {
+		if i == 0 || set[i-1]+1 != x {
+			n++
+		}
+	}
+	return n
+}
+
+// arrayRuns returns the elements of the given sorted set as runs of length one.
+func arrayRuns(set []uint16) []uint16 {
+	out := make([]uint16, 2*len(set))
+	for i, x := range set {
+		out[2*i], out[2*i+1] = x, x
+	}
+	return out
+}
+
+// appendRun appends the run [start, last] after the n runs in out. If the run overlaps or is
+// adjacent to the last run in out, they are merged. It returns the new number of runs in out.
+func appendRun(out []uint16, n int, start, last uint16) int {
+	if n > 0 {
+		if prev := out[2*n-1]; uint32(start) <= uint32(prev)+1 {
+			if last > prev {
+				out[2*n-1] = last
+			}
+			return n
+		}
+	}
+	out[2*n], out[2*n+1] = start, last
+	return n + 1
+}
+
+// unionRuns writes the union of the runs in a and b to out, and returns the number of runs written.
+// a, b and out hold runs as (start, last) pairs.
+func unionRuns(a, b, out []uint16) int {
+	var n, i, j int
+	for i < len(a) || j < len(b) {
+		if j == len(b) || (i < len(a) && a[i] <= b[j]) {
+			n = appendRun(out, n, a[i], a[i+1])
+			i += 2
+		} else {
+			n = appendRun(out, n, b[j], b[j+1])
+			j += 2
+		}
+	}
+	return n
+}
+
+// intersectRuns writes the intersection of the runs in a and b to out, and returns the number of
+// runs written.
+func intersectRuns(a, b, out []uint16) int {
+	var n, i, j int
+	for i < len(a) && j < len(b) {
+		start, last := max16(a[i], b[j]), min16(a[i+1], b[j+1])
+		if start <= last {
+			n = appendRun(out, n, start, last)
+		}
+		if a[i+1] < b[j+1] {
+			i += 2
+		} else {
+			j += 2
+		}
+	}
+	return n
+}
+
+// differenceRuns writes the elements present in the runs of a, but not in the runs of b to out. It
+// returns the number of runs written.
+func differenceRuns(a, b, out []uint16) int {
+	var n, j int
+	for i := 0; i < len(a); i += 2 {
+		start, last := uint32(a[i]), uint32(a[i+1])
+		for j < len(b) && uint32(b[j+1]) < start {
+			j += 2
+		}
+		for k := j; k < len(b) && uint32(b[k]) <= last && start <= last; k += 2 {
+			if uint32(b[k]) > start {
+				n = appendRun(out, n, uint16(start), b[k]-1)
+			}
+			start = uint32(b[k+1]) + 1
+		}
+		if start <= last {
+			n = appendRun(out, n, uint16(start), uint16(last))
+		}
+	}
+	return n
+}
+
+// xorRuns writes the elements present in exactly one of the runs of a and b to out. It returns the
+// number of runs written.
+func xorRuns(a, b, out []uint16) int {
+	// Each run [start, last] toggles the membership at start and at last+1. Walk over these
+	// boundaries of both a and b in order, and emit a run whenever the membership toggles off.
+	bound := func(runs []uint16, i int) uint32 {
+		if i%2 == 0 {
+			return uint32(runs[i])
+		}
+		return uint32(runs[i]) + 1
+	}
+	var n, i, j int
+	var inside bool
+	var start uint32
+	for i < len(a) || j < len(b) {
+		var x uint32
+		switch {
+		case j == len(b) || (i < len(a) && bound(a, i) < bound(b, j)):
+			x = bound(a, i)
+			i++
+		case i == len(a) || bound(b, j) < bound(a, i):
+			x = bound(b, j)
+			j++
+		default:
+			// Both a and b toggle at the same boundary. They cancel each other out.
+			i++
+			j++
+			continue
+		}
+		if inside {
+			// The runs of an array are adjacent to each other. So, a toggle off can happen at the
+			// same boundary as the preceding toggle on. Skip such empty runs.
+			if x > start {
+				n = appendRun(out, n, uint16(start), uint16(x-1))
+			}
+		} else {
+			start = x
+		}
+		inside = !inside
+	}
+	return n
+}
+
+var (
+	runInline = 0x01
+	runLazy   = 0x02
+)
+
+func containerOr(ac, bc, buf []uint16, runMode int) []uint16 {
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		left := array(ac)
+		right := array(bc)
+		// We can't always inline this function. If the right container has
+		// enough entries, trying to do a union with the left container inplace
+		// could end up overwriting the left container entries. So, we use a
+		// buffer to hold all output, and then copy it over to left.
+		//
+		// TODO: If right doesn't have a lot of entries, we could just iterate
+		// over left and merge the entries from right inplace. Would be faster
+		// than copying over all entries into buffer. Worth trying that approach.
+		return left.orArray(right, buf, runMode)
+	}
+	if at == typeArray && bt == typeBitmap {
+		left := array(ac)
+		right := bitmap(bc)
+		// Don't run inline for this call.
+		return right.orArray(left, buf, runMode&^runInline)
 	}
 
 	// These two following cases can be fully inlined.
@@ -705,6 +1705,34 @@ func containerOr(ac, bc, buf []uint16, runMode int) []uint16 {
 		right := bitmap(bc)
 		return left.orBitmap(right, buf, runMode)
 	}
+
+	// Run containers can't be ORed inline, because the result might need more runs than the
+	// container has space for.
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.orRun(right, buf)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.orArray(right, buf)
+	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return right.orArray(left, buf)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return right.orRun(left, buf, runMode&^runInline)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.orRun(right, buf, runMode)
+	}
 	panic("containerOr: We should not reach here")
 }
 
@@ -733,9 +1761,105 @@ func containerAnd(ac, bc []uint16) []uint16 {
 		right := bitmap(bc)
 		return left.andBitmap(right)
 	}
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.andRun(right)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.andArray(right)
+	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return right.andArray(left)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return right.andRun(left)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.andRun(right)
+	}
 	panic("containerAnd: We should not reach here")
 }
 
+func containerXor(ac, bc, buf []uint16, runMode int) []uint16 {
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		left := array(ac)
+		right := array(bc)
+		return left.xorArray(right, buf, runMode)
+	}
+	if at == typeArray && bt == typeBitmap {
+		left := array(ac)
+		right := bitmap(bc)
+		// Don't run inline for this call.
+		return right.xorArray(left, buf, runMode&^runInline)
+	}
+
+	// These two following cases can be fully inlined.
+	if at == typeBitmap && bt == typeArray {
+		left := bitmap(ac)
+		right := array(bc)
+		return left.xorArray(right, buf, runMode)
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		left := bitmap(ac)
+		right := bitmap(bc)
+		return left.xorBitmap(right, buf, runMode)
+	}
+
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.xorRun(right, buf)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.xorArray(right, buf)
+	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return right.xorArray(left, buf)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return right.xorRun(left, buf, runMode&^runInline)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.xorRun(right, buf, runMode)
+	}
+	panic("containerXor: We should not reach here")
+}
+
+// flipContainer returns the container c with the membership of all the elements in [lo, hi]
+// inverted. If the result is a bitmap container with only a few elements left, it gets converted to
+// an array container. With runInline, c might be flipped in place, in which case nil is returned.
+func flipContainer(c []uint16, lo, hi uint16, buf []uint16, runMode int) []uint16 {
+	out := containerXor(c, rangeContainer(lo, hi), buf, runMode)
+	res := out
+	if len(res) == 0 {
+		res = c
+	}
+	if res[indexType] == typeBitmap && getCardinality(res) < 4096 {
+		return bitmap(res).toArrayContainer(nil)
+	}
+	return out
+}
+
 // TODO: Optimize this function.
 func containerAndNot(ac, bc, buf []uint16) []uint16 {
 	at := ac[indexType]
@@ -762,5 +1886,271 @@ func containerAndNot(ac, bc, buf []uint16) []uint16 {
 		right := bitmap(bc)
 		return left.andNotBitmap(right)
 	}
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.andNotRun(right)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.andNotArray(right)
+	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return left.andNotRun(right)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return left.andNotBitmap(right, buf)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.andNotRun(right)
+	}
 	panic("containerAndNot: We should not reach here")
 }
+
+// cardinalityInRange returns the number of elements in [lo, hi] in the bitmap container.
+func (b bitmap) cardinalityInRange(lo, hi uint16) int {
+	data := b[startIdx:]
+	var num int
+	for i := lo >> 4; i <= hi>>4; i++ {
+		num += bits.OnesCount16(data[i] & wordMask(i, lo, hi))
+	}
+	return num
+}
+
+// bitCounter counts the number of containers each element is present in. The counts are kept
+// bit-sliced, i.e. the i-th slice holds the i-th bit of the counts of all the elements, laid out
+// like the data of a bitmap container. Counts which don't fit in the slices saturate to overflow.
+type bitCounter struct {
+	slices   [][]uint16
+	overflow []uint16
+}
+
+// newBitCounter returns a bitCounter with enough slices to count up to max.
+func newBitCounter(max int) *bitCounter {
+	n := int(maxContainerSize - startIdx)
+	bc := &bitCounter{overflow: make([]uint16, n)}
+	for i := 0; i < bits.Len(uint(max)); i++ {
+		bc.slices = append(bc.slices, make([]uint16, n))
+	}
+	return bc
+}
+
+func (bc *bitCounter) reset() {
+	for _, s := range bc.slices {
+		copy(s, zeroContainer)
+	}
+	copy(bc.overflow, zeroContainer)
+}
+
+// addWord increments the counts of the elements set in the word w, at index idx.
+func (bc *bitCounter) addWord(idx uint16, w uint16) {
+	for _, s := range bc.slices {
+		carry := s[idx] & w
+		s[idx] ^= w
+		if w = carry; w == 0 {
+			return
+		}
+	}
+	bc.overflow[idx] |= w
+}
+
+// add increments the counts of all the elements in the container c.
+func (bc *bitCounter) add(c []uint16) {
+	switch c[indexType] {
+	case typeArray:
+		// Elements falling within the same word are added together.
+		var idx, w uint16
+		for _, x := range array(c).all() {
+			if x>>4 != idx {
+				if w > 0 {
+					bc.addWord(idx, w)
+				}
+				idx, w = x>>4, 0
+			}
+			w |= bitmapMask[x&0xF]
+		}
+		if w > 0 {
+			bc.addWord(idx, w)
+		}
+	case typeBitmap:
+		for idx, w := range c[startIdx:] {
+			if w > 0 {
+				bc.addWord(uint16(idx), w)
+			}
+		}
+	case typeRun:
+		r := run(c)
+		for i := 0; i < r.numRuns(); i++ {
+			lo, hi := r.start(i), r.last(i)
+			for idx := lo >> 4; idx <= hi>>4; idx++ {
+				bc.addWord(idx, wordMask(idx, lo, hi))
+			}
+		}
+	}
+}
+
+// atLeast returns a container with the elements whose count is at least k. It uses buf to build
+// the container. k must fit within the slices.
+func (bc *bitCounter) atLeast(k int, buf []uint16) []uint16 {
+	assert(len(buf) == maxContainerSize)
+	b := bitmap(buf)
+	b[indexSize] = maxContainerSize
+	b[indexType] = typeBitmap
+
+	data := b[startIdx:]
+	var card int
+	for idx := range data {
+		// Compare the counts with k, starting from the most significant bit. eq tracks the
+		// elements whose counts are equal to k so far, and gt the ones which are greater.
+		gt, eq := bc.overflow[idx], uint16(0xFFFF)
+		for i := len(bc.slices) - 1; i >= 0; i-- {
+			w := bc.slices[i][idx]
+			if k&(1<<i) > 0 {
+				eq &= w
+			} else {
+				gt |= eq & w
+				eq &^= w
+			}
+		}
+		data[idx] = gt | eq
+		card += bits.OnesCount16(data[idx])
+	}
+	setCardinality(b, card)
+	if card < 4096 {
+		return b.toArrayContainer(nil)
+	}
+	return b
+}
+
+// containerAndCardinality returns the number of elements present in both the containers, without
+// materializing their intersection.
+func containerAndCardinality(ac, bc []uint16) int {
+	// Order the containers by type, so only one of the symmetric cases needs to be handled.
+	if ac[indexType] > bc[indexType] {
+		ac, bc = bc, ac
+	}
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		return intersection2by2Cardinality(array(ac).all(), array(bc).all())
+	}
+	if at == typeArray {
+		var num int
+		for _, x := range array(ac).all() {
+			if containerHas(bc, x) {
+				num++
+			}
+		}
+		return num
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		a, b := ac[startIdx:], bc[startIdx:]
+		var num int
+		for i := range a {
+			num += bits.OnesCount16(a[i] & b[i])
+		}
+		return num
+	}
+	if at == typeBitmap && bt == typeRun {
+		r := run(bc)
+		var num int
+		for i := 0; i < r.numRuns(); i++ {
+			num += bitmap(ac).cardinalityInRange(r.start(i), r.last(i))
+		}
+		return num
+	}
+	if at == typeRun && bt == typeRun {
+		a, b := run(ac).runs(), run(bc).runs()
+		var num, i, j int
+		for i < len(a) && j < len(b) {
+			start, last := max16(a[i], b[j]), min16(a[i+1], b[j+1])
+			if start <= last {
+				num += int(last-start) + 1
+			}
+			if a[i+1] < b[j+1] {
+				i += 2
+			} else {
+				j += 2
+			}
+		}
+		return num
+	}
+	panic("containerAndCardinality: We should not reach here")
+}
+
+// containerEquals returns true if both the containers hold the same elements, irrespective of
+// their types and sizes.
+func containerEquals(ac, bc []uint16) bool {
+	card := getCardinality(ac)
+	if card != getCardinality(bc) {
+		return false
+	}
+	if ac[indexType] == typeArray && bc[indexType] == typeArray {
+		return equal(array(ac).all(), array(bc).all())
+	}
+	return containerAndCardinality(ac, bc) == card
+}
+
+// containerIntersects returns true if the containers have at least one element in common. Unlike
+// containerAndCardinality, it returns as soon as such an element is found.
+func containerIntersects(ac, bc []uint16) bool {
+	if ac[indexType] > bc[indexType] {
+		ac, bc = bc, ac
+	}
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		return intersects2by2(array(ac).all(), array(bc).all())
+	}
+	if at == typeArray {
+		for _, x := range array(ac).all() {
+			if containerHas(bc, x) {
+				return true
+			}
+		}
+		return false
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		a, b := ac[startIdx:], bc[startIdx:]
+		for i := range a {
+			if a[i]&b[i] > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if at == typeBitmap && bt == typeRun {
+		r := run(bc)
+		for i := 0; i < r.numRuns(); i++ {
+			if bitmap(ac).cardinalityInRange(r.start(i), r.last(i)) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if at == typeRun && bt == typeRun {
+		a, b := run(ac).runs(), run(bc).runs()
+		var i, j int
+		for i < len(a) && j < len(b) {
+			if max16(a[i], b[j]) <= min16(a[i+1], b[j+1]) {
+				return true
+			}
+			if a[i+1] < b[j+1] {
+				i += 2
+			} else {
+				j += 2
+			}
+		}
+		return false
+	}
+	panic("containerIntersects: We should not reach here")
+}
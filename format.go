@@ -0,0 +1,206 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+// A bitmap can be serialized in two layouts:
+//
+// The legacy layout, returned by ToBuffer, is the raw data of the bitmap, i.e. the node of keys
+// followed by the containers.
+//
+// The versioned layout prepends a header of 8 bytes to the raw data:
+//   [0:4] the magic "SROA".
+//   [4:6] the format version, as a little-endian uint16.
+//   [6:8] the flags, as a little-endian uint16.
+// If flagChecksum is set, the raw data is followed by a trailer of 4 bytes, holding the CRC32C
+// (Castagnoli) of the header and the raw data, as a little-endian uint32.
+//
+// The raw data is always in the little-endian byte order, irrespective of the host. The node of
+// keys is made of uint64s, and the containers of uint16s. So, converting the raw data to and from
+// big-endian swaps the bytes of each uint64 in the node, and of each uint16 in the containers.
+//
+// The header is 8 bytes long, so the raw data stays 8 byte aligned. That allows FromBuffer to
+// use it without making a copy. A legacy buffer starts with the node size, as a uint64. Its 4th to
+// 8th bytes are zero, unless the node takes up more than 8GB. The version is never zero, which
+// allows telling the two layouts apart.
+
+const (
+	formatVersion uint16 = 1
+
+	// flagChecksum marks the presence of the CRC32C trailer.
+	flagChecksum uint16 = 1 << 0
+
+	headerSize   = 8
+	checksumSize = 4
+)
+
+var (
+	formatMagic     = []byte("SROA")
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Errors returned by FromBufferChecked for buffers in the versioned layout.
+var (
+	ErrFormatVersion = errors.New("unsupported format version")
+	ErrFormatFlags   = errors.New("unsupported format flags")
+	ErrChecksum      = errors.New("checksum mismatch")
+)
+
+// BufferOptions configure the layout of the buffer returned by ToBufferWithOptions.
+type BufferOptions struct {
+	// Versioned prepends the format header to the bitmap. Otherwise, the legacy layout is used.
+	Versioned bool
+	// Checksum appends a CRC32C trailer to the bitmap. It's only used with Versioned.
+	Checksum bool
+}
+
+// ToBufferWithOptions returns the bitmap serialized in the layout chosen via opt. Unlike ToBuffer,
+// the versioned layout always makes a copy of the bitmap. FromBuffer accepts both the layouts.
+func (ra *Bitmap) ToBufferWithOptions(opt BufferOptions) []byte {
+	if !opt.Versioned {
+		return ra.ToBuffer()
+	}
+
+	var flags uint16
+	var data []byte
+	if !ra.IsEmpty() {
+		data = toCanonical(ra.data, false)
+	}
+	sz := headerSize + len(data)
+	if opt.Checksum {
+		flags |= flagChecksum
+		sz += checksumSize
+	}
+
+	buf := make([]byte, sz)
+	copy(buf, formatMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], formatVersion)
+	binary.LittleEndian.PutUint16(buf[6:8], flags)
+	n := headerSize + copy(buf[headerSize:], data)
+	if opt.Checksum {
+		binary.LittleEndian.PutUint32(buf[n:], crc32.Checksum(buf[:n], castagnoliTable))
+	}
+	return buf
+}
+
+// isVersioned returns true if the buffer starts with the format header.
+func isVersioned(buf []byte) bool {
+	return len(buf) >= headerSize && bytes.Equal(buf[:4], formatMagic) &&
+		binary.LittleEndian.Uint16(buf[4:6]) != 0
+}
+
+// bitmapData strips the format header and the checksum trailer from the buffer, if present, and
+// returns the raw data of the bitmap. The checksum is only verified if verify is set. Legacy
+// buffers are returned as they are.
+func bitmapData(buf []byte, verify bool) ([]byte, error) {
+	if !isVersioned(buf) {
+		return buf, nil
+	}
+	if version := binary.LittleEndian.Uint16(buf[4:6]); version != formatVersion {
+		return nil, errors.Wrapf(ErrFormatVersion, "version: %d", version)
+	}
+	flags := binary.LittleEndian.Uint16(buf[6:8])
+	if flags&^flagChecksum != 0 {
+		return nil, errors.Wrapf(ErrFormatFlags, "flags: %#x", flags)
+	}
+	if flags&flagChecksum == 0 {
+		return buf[headerSize:], nil
+	}
+
+	n := len(buf) - checksumSize
+	if n < headerSize {
+		return nil, errors.Wrapf(ErrBufferLength, "no space for checksum in length: %d", len(buf))
+	}
+	if verify {
+		if exp, got := binary.LittleEndian.Uint32(buf[n:]),
+			crc32.Checksum(buf[:n], castagnoliTable); exp != got {
+			return nil, errors.Wrapf(ErrChecksum, "expected: %#x, got: %#x", exp, got)
+		}
+	}
+	return buf[headerSize:n], nil
+}
+
+// toCanonical returns the raw data of a bitmap, which is in the host byte order, as bytes in the
+// canonical little-endian byte order. On little-endian hosts, it only makes a copy if alwaysCopy is
+// set.
+func toCanonical(data []uint16, alwaysCopy bool) []byte {
+	if hostLittleEndian && !alwaysCopy {
+		return toByteSlice(data)
+	}
+	out := make([]uint16, len(data))
+	copy(out, data)
+	buf := toByteSlice(out)
+	if !hostLittleEndian {
+		swapByteOrder(buf, false)
+	}
+	return buf
+}
+
+// fromCanonical returns the raw data of a bitmap, given as bytes in the canonical little-endian
+// byte order, in the host byte order. On little-endian hosts, it only makes a copy if alwaysCopy is
+// set.
+func fromCanonical(buf []byte, alwaysCopy bool) []uint16 {
+	if hostLittleEndian && !alwaysCopy {
+		return toUint16Slice(buf)
+	}
+	out := make([]uint16, len(buf)/2)
+	copy(toByteSlice(out), buf)
+	if !hostLittleEndian {
+		swapByteOrder(toByteSlice(out), true)
+	}
+	return out
+}
+
+// swapByteOrder converts the raw data of a bitmap in buf from little-endian to big-endian, or the
+// other way around, in place. toHost tells whether buf is being converted to the host byte order,
+// or from it. That decides when the node size can be read from buf.
+func swapByteOrder(buf []byte, toHost bool) {
+	if len(buf) < 8 {
+		return
+	}
+	nodeSize := func() uint64 { return toUint64Slice(toUint16Slice(buf[:8]))[indexNodeSize] }
+	var sz uint64
+	if !toHost {
+		sz = nodeSize()
+	}
+	reverse8 := func(b []byte) {
+		b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7] = b[7], b[6], b[5], b[4], b[3], b[2], b[1], b[0]
+	}
+	reverse8(buf)
+	if toHost {
+		sz = nodeSize()
+	}
+
+	// A corrupted node size shouldn't cause a panic here. FromBufferChecked would report it.
+	n := len(buf) &^ 7
+	if sz < uint64(n)/2 {
+		n = int(sz*2) &^ 7
+	}
+	for i := 8; i < n; i += 8 {
+		reverse8(buf[i : i+8])
+	}
+	for i := n; i+1 < len(buf); i += 2 {
+		buf[i], buf[i+1] = buf[i+1], buf[i]
+	}
+}
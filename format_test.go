@@ -0,0 +1,173 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferFormats(t *testing.T) {
+	a, _ := randomBitmap(8)
+	opts := []BufferOptions{
+		{},
+		{Versioned: true},
+		{Versioned: true, Checksum: true},
+		// Checksum is ignored for the legacy layout.
+		{Checksum: true},
+	}
+	for _, opt := range opts {
+		buf := a.ToBufferWithOptions(opt)
+		require.Equal(t, opt.Versioned, isVersioned(buf))
+
+		require.True(t, Equals(a, FromBuffer(buf)))
+		require.True(t, Equals(a, FromBufferWithCopy(buf)))
+		b, err := FromBufferChecked(buf)
+		require.NoError(t, err)
+		require.True(t, Equals(a, b))
+
+		// The bitmap read from a copy can be modified.
+		c := FromBufferWithCopy(buf)
+		c.Set(100 << 16)
+		require.True(t, c.Contains(100<<16))
+	}
+
+	// The legacy layout is the same as ToBuffer.
+	require.Equal(t, a.ToBuffer(), a.ToBufferWithOptions(BufferOptions{}))
+
+	// Empty bitmaps.
+	for _, opt := range opts {
+		buf := NewBitmap().ToBufferWithOptions(opt)
+		require.True(t, FromBuffer(buf).IsEmpty())
+		b, err := FromBufferChecked(buf)
+		require.NoError(t, err)
+		require.True(t, b.IsEmpty())
+	}
+}
+
+func TestBufferFormatErrors(t *testing.T) {
+	a, _ := randomBitmap(8)
+	versioned := func() []byte {
+		return a.ToBufferWithOptions(BufferOptions{Versioned: true, Checksum: true})
+	}
+
+	buf := versioned()
+	buf[headerSize+100] ^= 1
+	_, err := FromBufferChecked(buf)
+	require.True(t, errors.Is(err, ErrChecksum), "got: %v", err)
+
+	buf = versioned()
+	buf[len(buf)-1] ^= 1
+	_, err = FromBufferChecked(buf)
+	require.True(t, errors.Is(err, ErrChecksum), "got: %v", err)
+
+	buf = versioned()
+	binary.LittleEndian.PutUint16(buf[4:6], formatVersion+1)
+	_, err = FromBufferChecked(buf)
+	require.True(t, errors.Is(err, ErrFormatVersion), "got: %v", err)
+	// FromBuffer has no error to return, but it must not exit the process either.
+	require.Panics(t, func() { FromBuffer(buf) })
+	require.Panics(t, func() { FromBufferWithCopy(buf) })
+
+	buf = versioned()
+	binary.LittleEndian.PutUint16(buf[6:8], 1<<5)
+	_, err = FromBufferChecked(buf)
+	require.True(t, errors.Is(err, ErrFormatFlags), "got: %v", err)
+	require.Panics(t, func() { FromBuffer(buf) })
+
+	// Without the checksum, the corruption is caught by the validation of the bitmap itself.
+	buf = a.ToBufferWithOptions(BufferOptions{Versioned: true})
+	buf = buf[:len(buf)-2]
+	_, err = FromBufferChecked(buf)
+	require.True(t, errors.Is(err, ErrContainerSize), "got: %v", err)
+}
+
+func TestSwapByteOrder(t *testing.T) {
+	if !hostLittleEndian {
+		t.Skip("The test expects a little-endian host")
+	}
+	a, _ := randomBitmap(8)
+	le := a.ToBufferWithCopy()
+	nodeSize := int(binary.LittleEndian.Uint64(le[:8]))
+
+	be := make([]byte, len(le))
+	copy(be, le)
+	swapByteOrder(be, false)
+
+	// The node is made of uint64s, and the containers of uint16s.
+	for i := 0; i < nodeSize*2; i += 8 {
+		require.Equal(t, binary.LittleEndian.Uint64(le[i:]), binary.BigEndian.Uint64(be[i:]))
+	}
+	for i := nodeSize * 2; i < len(le); i += 2 {
+		require.Equal(t, binary.LittleEndian.Uint16(le[i:]), binary.BigEndian.Uint16(be[i:]))
+	}
+
+	// Swapping again gives back the little-endian data.
+	swapByteOrder(be, true)
+	require.Equal(t, le, be)
+
+	// A corrupted node size shouldn't cause a panic.
+	binary.LittleEndian.PutUint64(be, 1<<62)
+	swapByteOrder(be, false)
+	swapByteOrder(be[:len(be)-1], true)
+	swapByteOrder(be[:7], true)
+}
+
+func TestSimulatedBigEndian(t *testing.T) {
+	if !hostLittleEndian {
+		t.Skip("The test expects a little-endian host")
+	}
+	a, _ := randomBitmap(8)
+	le := a.ToBufferWithCopy()
+
+	// Pretend that the host is big-endian. The data of a is actually little-endian, so it gets
+	// serialized as big-endian. Reading it back should swap the bytes again.
+	hostLittleEndian = false
+	defer func() { hostLittleEndian = true }()
+
+	buf := a.ToBuffer()
+	exp := make([]byte, len(le))
+	copy(exp, le)
+	swapByteOrder(exp, false)
+	require.Equal(t, exp, buf)
+
+	// ToBuffer must have made a copy, which doesn't share memory with the bitmap.
+	buf[0] ^= 1
+	require.Equal(t, le, toByteSlice(a.data))
+	buf[0] ^= 1
+
+	require.True(t, Equals(a, FromBuffer(buf)))
+	require.True(t, Equals(a, FromBufferWithCopy(buf)))
+	b, err := FromBufferChecked(buf)
+	require.NoError(t, err)
+	require.True(t, Equals(a, b))
+	// FromBuffer must have made a copy, instead of swapping the given buffer in place.
+	require.Equal(t, exp, buf)
+
+	vbuf := a.ToBufferWithOptions(BufferOptions{Versioned: true, Checksum: true})
+	b, err = FromBufferChecked(vbuf)
+	require.NoError(t, err)
+	require.True(t, Equals(a, b))
+
+	c := a.Clone()
+	c.Set(100 << 16)
+	require.True(t, c.Contains(100<<16))
+	require.False(t, a.Contains(100<<16))
+}
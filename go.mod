@@ -1,10 +1,17 @@
 module github.com/dgraph-io/sroar
 
-go 1.16
+go 1.21
 
 require (
 	github.com/RoaringBitmap/roaring v0.6.1
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/mschoch/smat v0.0.0-20160514031455-90eadee771ae // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/willf/bitset v1.1.10 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
@@ -17,6 +17,7 @@
 package sroar
 
 import (
+	"math"
 	"math/bits"
 )
 
@@ -25,11 +26,24 @@ type Iterator struct {
 
 	keys   []uint64
 	keyIdx int
+	// keyStart is the index of the first key of the iterator in the node of keys.
+	keyStart int
 
 	contIdx int
 
 	bitmapIdx int
 	bitset    uint16
+
+	// runIdx and runVal track the current run and the last value returned from it, when iterating
+	// over a run container.
+	runIdx int
+	runVal uint16
+
+	// lo is the smallest element the iterator can return. lastCard is the number of elements the
+	// iterator returns from its last container, or -1 if it returns all of them. They bound the
+	// iterators returned by NewIteratorRange.
+	lo       uint64
+	lastCard int
 }
 
 func (bm *Bitmap) NewRangeIterators(numRanges int) []*Iterator {
@@ -48,6 +62,7 @@ func (bm *Bitmap) NewRangeIterators(numRanges int) []*Iterator {
 			n = width + 1
 		}
 		iters[i].keys = iters[i].keys[cnt : cnt+2*n]
+		iters[i].keyStart = cnt / 2
 		cnt = cnt + 2*n
 	}
 	return iters
@@ -60,37 +75,137 @@ func (bm *Bitmap) NewIterator() *Iterator {
 		keyIdx:    0,
 		contIdx:   -1,
 		bitmapIdx: -1,
+		runIdx:    -1,
+		lastCard:  -1,
 	}
 }
 
-func (it *Iterator) Next() uint64 {
+// NewIteratorRange returns an iterator over the elements of the bitmap in [lo, hi).
+func (bm *Bitmap) NewIteratorRange(lo, hi uint64) *Iterator {
+	if lo >= hi {
+		it := bm.NewIterator()
+		it.keys = nil
+		return it
+	}
+	return bm.newIteratorBetween(lo, hi-1)
+}
+
+// NewBalancedIterators splits the bitmap into numIters ranges of values, holding about the same
+// number of elements, and returns an iterator for each of them. Unlike NewRangeIterators, the
+// ranges are balanced by the cardinality of the containers, and can split a container. The
+// iterators are returned in sorted order.
+func (bm *Bitmap) NewBalancedIterators(numIters int) []*Iterator {
+	total := bm.GetCardinality()
+	// With fewer elements than iterators, each iterator gets one element, and the rest are empty.
+	num := numIters
+	if total < num {
+		num = total
+	}
+
+	// The i-th iterator starts at the element with rank i*total/num. Find these elements in a
+	// single pass over the containers.
+	starts := make([]uint64, numIters)
+	var seen int
+	next := 1
+	for i := 0; i < bm.keys.numKeys() && next < num; i++ {
+		c := bm.getContainer(bm.keys.val(i))
+		card := getCardinality(c)
+		for next < num {
+			rank := next * total / num
+			if rank >= seen+card {
+				break
+			}
+			starts[next] = bm.keys.key(i) | uint64(containerSelect(c, rank-seen))
+			next++
+		}
+		seen += card
+	}
+
+	iters := make([]*Iterator, numIters)
+	for i := range iters {
+		switch {
+		case i >= num:
+			iters[i] = bm.NewIteratorRange(0, 0)
+		case i == num-1:
+			iters[i] = bm.newIteratorBetween(starts[i], math.MaxUint64)
+		default:
+			iters[i] = bm.NewIteratorRange(starts[i], starts[i+1])
+		}
+	}
+	return iters
+}
+
+// newIteratorBetween returns an iterator over the elements of the bitmap in [lo, last].
+func (bm *Bitmap) newIteratorBetween(lo, last uint64) *Iterator {
+	it := bm.NewIterator()
+	start := bm.keys.search(lo & mask)
+	end := bm.keys.search(last & mask)
+	if end < bm.keys.numKeys() && bm.keys.key(end) == last&mask {
+		// The last container holds hi. Only return its elements up to last.
+		it.lastCard = containerCountUpTo(bm.getContainer(bm.keys.val(end)), uint16(last))
+		end++
+	}
+	it.keys = it.keys[2*start : 2*end]
+	it.keyStart = start
+	it.lo = lo
+	it.Seek(lo)
+	return it
+}
+
+// cardinality returns the number of elements the iterator returns from the current container.
+func (it *Iterator) cardinality(cont []uint16) int {
+	if it.lastCard >= 0 && it.keyIdx == len(it.keys)-2 {
+		return it.lastCard
+	}
+	return getCardinality(cont)
+}
+
+// HasNext returns true if the iterator has elements left, i.e. if the following call to Next
+// returns an element of the bitmap. Unlike checking the value returned by Next, it also works for
+// bitmaps containing 0.
+func (it *Iterator) HasNext() bool {
+	return it.advance()
+}
+
+// advance moves the iterator to the next container with elements left, if the current container
+// has none left. It returns false if there are no elements left at all.
+func (it *Iterator) advance() bool {
 	if len(it.keys) == 0 {
-		return 0
+		return false
 	}
 
-	key := it.keys[it.keyIdx]
-	off := it.keys[it.keyIdx+1]
-	cont := it.bm.getContainer(off)
-	card := getCardinality(cont)
+	cont := it.bm.getContainer(it.keys[it.keyIdx+1])
+	card := it.cardinality(cont)
 
 	// Loop until we find a container on which next operation is possible. When such a container
 	// is found, reset the variables responsible for container iteration.
 	for card == 0 || it.contIdx+1 >= card {
 		if it.keyIdx+2 >= len(it.keys) {
-			return 0
+			return false
 		}
 		// jump by 2 because key is followed by a value
 		it.keyIdx += 2
 		it.contIdx = -1
 		it.bitmapIdx = -1
 		it.bitset = 0
-		key = it.keys[it.keyIdx]
-		off = it.keys[it.keyIdx+1]
-		cont = it.bm.getContainer(off)
-		card = getCardinality(cont)
+		it.runIdx = -1
+		cont = it.bm.getContainer(it.keys[it.keyIdx+1])
+		card = it.cardinality(cont)
+	}
+	return true
+}
+
+// Next returns the next element of the bitmap. Once there are no elements left, it returns 0,
+// which can't be told apart from the element 0. So, HasNext should be used to check for more
+// elements, if the bitmap can contain 0.
+func (it *Iterator) Next() uint64 {
+	if !it.advance() {
+		return 0
 	}
+	key := it.keys[it.keyIdx]
+	cont := it.bm.getContainer(it.keys[it.keyIdx+1])
 
-	//  The above loop assures that we can do next in this container.
+	// advance assures that we can do next in this container.
 	it.contIdx++
 	switch cont[indexType] {
 	case typeArray:
@@ -110,32 +225,317 @@ func (it *Iterator) Next() uint64 {
 		msb := 1 << (16 - msbIdx - 1)
 		it.bitset ^= uint16(msb)
 		return key | uint64(it.bitmapIdx*16+int(msbIdx))
+	case typeRun:
+		r := run(cont)
+		// Move to the next run once we have returned the last value of the current one.
+		if it.runIdx < 0 || it.runVal == r.last(it.runIdx) {
+			it.runIdx++
+			it.runVal = r.start(it.runIdx)
+		} else {
+			it.runVal++
+		}
+		return key | uint64(it.runVal)
 	}
 	return 0
 }
 
-type ManyItr struct {
-	index int
-	arr   []uint64
+// Seek moves the iterator to the first element >= x, so that the following call to Next returns
+// it. It can move the iterator both forward and backward. The iterators returned by
+// NewRangeIterators and NewIteratorRange stay within their range. If there's no such element, the
+// iterator is exhausted.
+func (it *Iterator) Seek(x uint64) {
+	n := len(it.keys) / 2
+	if n == 0 {
+		return
+	}
+	if x < it.lo {
+		x = it.lo
+	}
+	key := x & mask
+	lo := uint16(x)
+
+	// Jump to the first container with a key >= the key of x, and reset the variables responsible
+	// for container iteration.
+	idx := it.bm.keys.search(key) - it.keyStart
+	if idx < 0 {
+		idx, lo = 0, 0
+	}
+	if idx >= n {
+		// Move past the last element of the last container.
+		it.keyIdx = 2 * (n - 1)
+		it.contIdx = maxCardinality
+		return
+	}
+	it.keyIdx = 2 * idx
+	it.contIdx = -1
+	it.bitmapIdx = -1
+	it.bitset = 0
+	it.runIdx = -1
+	if it.keys[it.keyIdx] != key || lo == 0 {
+		return
+	}
+
+	// x falls within this container. Position the iterator right before the first element >= lo.
+	// contIdx is the number of elements < lo, minus one.
+	cont := it.bm.getContainer(it.keys[it.keyIdx+1])
+	switch cont[indexType] {
+	case typeArray:
+		it.contIdx = array(cont).find(lo) - 1
+	case typeBitmap:
+		it.bitmapIdx = int(lo >> 4)
+		// The bits are stored with the most significant bit first. Keep the bits for lo and
+		// above in the word.
+		it.bitset = cont[int(startIdx)+it.bitmapIdx] & (0xFFFF >> (lo & 0xF))
+		it.contIdx = bitmap(cont).countBefore(lo) - 1
+	case typeRun:
+		r := run(cont)
+		i := r.find(lo)
+		var num int
+		for j := 0; j < i; j++ {
+			num += int(r.last(j)-r.start(j)) + 1
+		}
+		switch {
+		case i == r.numRuns():
+		case lo > r.start(i):
+			// Continue in the middle of the run.
+			num += int(lo - r.start(i))
+			it.runIdx, it.runVal = i, lo-1
+		case i > 0:
+			// Continue at the start of the run, right after the end of the previous one.
+			it.runIdx, it.runVal = i-1, r.last(i-1)
+		}
+		it.contIdx = num - 1
+	}
 }
 
-// TODO: See if this is needed, we should remove this
-func (r *Bitmap) ManyIterator() *ManyItr {
-	return &ManyItr{
-		arr: r.ToArray(),
+// ReverseIterator iterates over the elements of a bitmap in descending order.
+type ReverseIterator struct {
+	bm *Bitmap
+
+	// keyIdx is the index of the current container in the node of keys. It's -1 once the
+	// iterator is exhausted.
+	keyIdx int
+	cont   []uint16
+
+	// idx is the position within the current container. For array containers, it's the index of
+	// the next element. For bitmap containers, it's the index of the current word, whose bits left
+	// are in bitset. For run containers, it's the index of the current run, whose next value is
+	// runVal. The container has no elements left once idx is negative.
+	idx    int
+	bitset uint16
+	runVal uint16
+}
+
+// NewReverseIterator returns an iterator over the elements of the bitmap, starting from the
+// largest one.
+func (bm *Bitmap) NewReverseIterator() *ReverseIterator {
+	it := &ReverseIterator{bm: bm}
+	it.enter(bm.keys.numKeys() - 1)
+	return it
+}
+
+// enter moves the iterator to the end of the container at index keyIdx.
+func (it *ReverseIterator) enter(keyIdx int) {
+	it.keyIdx = keyIdx
+	if keyIdx < 0 {
+		return
+	}
+	it.cont = it.bm.getContainer(it.bm.keys.val(keyIdx))
+	switch it.cont[indexType] {
+	case typeArray:
+		it.idx = getCardinality(it.cont) - 1
+	case typeBitmap:
+		it.idx = len(it.cont) - int(startIdx) - 1
+		it.bitset = it.cont[int(startIdx)+it.idx]
+	case typeRun:
+		r := run(it.cont)
+		it.idx = r.numRuns() - 1
+		if it.idx >= 0 {
+			it.runVal = r.last(it.idx)
+		}
+	}
+}
+
+// advance moves the iterator to the previous container with elements left, if the current
+// container has none left. It returns false if there are no elements left at all.
+func (it *ReverseIterator) advance() bool {
+	for it.keyIdx >= 0 {
+		if it.cont[indexType] == typeBitmap {
+			// Scan the words from the end, until we find one with bits left.
+			for it.bitset == 0 && it.idx > 0 {
+				it.idx--
+				it.bitset = it.cont[int(startIdx)+it.idx]
+			}
+			if it.bitset > 0 {
+				return true
+			}
+		} else if it.idx >= 0 {
+			return true
+		}
+		it.enter(it.keyIdx - 1)
+	}
+	return false
+}
+
+// HasNext returns true if the iterator has elements left, i.e. if the following call to Next
+// returns an element of the bitmap.
+func (it *ReverseIterator) HasNext() bool {
+	return it.advance()
+}
+
+// Next returns the next element of the bitmap, in descending order. Once there are no elements
+// left, it returns 0, which can't be told apart from the element 0. So, HasNext should be used to
+// check for more elements, if the bitmap can contain 0.
+func (it *ReverseIterator) Next() uint64 {
+	if !it.advance() {
+		return 0
 	}
+	key := it.bm.keys.key(it.keyIdx)
 
+	switch it.cont[indexType] {
+	case typeArray:
+		x := it.cont[int(startIdx)+it.idx]
+		it.idx--
+		return key | uint64(x)
+	case typeBitmap:
+		// The bits are stored with the most significant bit first. So, the trailing set bit is the
+		// largest element in the word.
+		tz := bits.TrailingZeros16(it.bitset)
+		it.bitset &^= 1 << tz
+		return key | uint64(it.idx<<4|(15-tz))
+	case typeRun:
+		r := run(it.cont)
+		x := it.runVal
+		// Move to the previous run once we have returned the first value of the current one.
+		if x == r.start(it.idx) {
+			it.idx--
+			if it.idx >= 0 {
+				it.runVal = r.last(it.idx)
+			}
+		} else {
+			it.runVal--
+		}
+		return key | uint64(x)
+	}
+	return 0
 }
 
+// Seek moves the iterator to the largest element <= x, so that the following call to Next returns
+// it. It can move the iterator both forward and backward. If there's no such element, the iterator
+// is exhausted.
+func (it *ReverseIterator) Seek(x uint64) {
+	key := x & mask
+	lo := uint16(x)
+
+	keys := it.bm.keys
+	idx := keys.search(key)
+	if idx == keys.numKeys() || keys.key(idx) != key {
+		// x falls before the container at idx. So, continue from the end of the previous one.
+		it.enter(idx - 1)
+		return
+	}
+
+	// x falls within this container. Position the iterator at the largest element <= lo.
+	it.enter(idx)
+	switch it.cont[indexType] {
+	case typeArray:
+		a := array(it.cont)
+		i := a.find(lo)
+		if i == getCardinality(a) || a[int(startIdx)+i] != lo {
+			i--
+		}
+		it.idx = i
+	case typeBitmap:
+		// Keep the bits for lo and below in the word.
+		it.idx = int(lo >> 4)
+		it.bitset = it.cont[int(startIdx)+it.idx] & (0xFFFF << (15 - lo&0xF))
+	case typeRun:
+		r := run(it.cont)
+		i := r.find(lo)
+		if i < r.numRuns() && r.start(i) <= lo {
+			it.idx, it.runVal = i, lo
+		} else {
+			it.idx = i - 1
+			if it.idx >= 0 {
+				it.runVal = r.last(it.idx)
+			}
+		}
+	}
+}
+
+// ManyItr iterates over the elements of a bitmap in batches. It decodes the containers directly
+// into the buffer passed to NextMany.
+type ManyItr struct {
+	it *Iterator
+}
+
+func (r *Bitmap) ManyIterator() *ManyItr {
+	return &ManyItr{it: r.NewIterator()}
+}
+
+// NextMany fills buf with the next elements of the bitmap, and returns the number of elements
+// written. It returns 0 once there are no elements left.
 func (itr *ManyItr) NextMany(buf []uint64) int {
-	count := 0
-	for i := 0; i < len(buf); i++ {
-		if itr.index == len(itr.arr) {
-			break
+	it := itr.it
+	var n int
+	for n < len(buf) && it.advance() {
+		key := it.keys[it.keyIdx]
+		cont := it.bm.getContainer(it.keys[it.keyIdx+1])
+		card := it.cardinality(cont)
+
+		switch cont[indexType] {
+		case typeArray:
+			data := cont[int(startIdx)+it.contIdx+1 : int(startIdx)+card]
+			if len(data) > len(buf)-n {
+				data = data[:len(buf)-n]
+			}
+			for i, x := range data {
+				buf[n+i] = key | uint64(x)
+			}
+			n += len(data)
+			it.contIdx += len(data)
+		case typeBitmap:
+			data := cont[startIdx:]
+			for n < len(buf) && it.contIdx+1 < card {
+				for it.bitset == 0 {
+					it.bitmapIdx++
+					it.bitset = data[it.bitmapIdx]
+				}
+				// Decode the bits left in the word, as long as there's space in buf.
+				base := key | uint64(it.bitmapIdx<<4)
+				for it.bitset > 0 && n < len(buf) && it.contIdx+1 < card {
+					pos := bits.LeadingZeros16(it.bitset)
+					it.bitset &^= bitmapMask[pos]
+					buf[n] = base | uint64(pos)
+					n++
+					it.contIdx++
+				}
+			}
+		case typeRun:
+			r := run(cont)
+			for n < len(buf) && it.contIdx+1 < card {
+				if it.runIdx < 0 || it.runVal == r.last(it.runIdx) {
+					it.runIdx++
+					it.runVal = r.start(it.runIdx)
+				} else {
+					it.runVal++
+				}
+				// Decode the rest of the run, as long as there's space in buf.
+				num := int(r.last(it.runIdx)-it.runVal) + 1
+				if num > len(buf)-n {
+					num = len(buf) - n
+				}
+				if num > card-it.contIdx-1 {
+					num = card - it.contIdx - 1
+				}
+				for i := 0; i < num; i++ {
+					buf[n+i] = key | uint64(it.runVal+uint16(i))
+				}
+				it.runVal += uint16(num - 1)
+				n += num
+				it.contIdx += num
+			}
 		}
-		buf[i] = itr.arr[itr.index]
-		itr.index++
-		count++
 	}
-	return count
+	return n
 }
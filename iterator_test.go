@@ -17,6 +17,7 @@
 package sroar
 
 import (
+	"math"
 	"math/rand"
 	"sort"
 	"testing"
@@ -51,8 +52,8 @@ func TestIteratorRanges(t *testing.T) {
 	cnt := uint64(1)
 	for idx := 0; idx < 8; idx++ {
 		it := iters[idx]
-		for v := it.Next(); v > 0; v = it.Next() {
-			require.Equal(t, cnt, v)
+		for it.HasNext() {
+			require.Equal(t, cnt, it.Next())
 			cnt++
 		}
 	}
@@ -99,12 +100,294 @@ func TestIteratorWithRemoveKeys(t *testing.T) {
 	it := b.NewIterator()
 
 	cnt := 0
-	for it.Next() > 0 {
+	for it.HasNext() {
+		it.Next()
 		cnt++
 	}
 	require.Equal(t, 0, cnt)
 }
 
+func TestIteratorZero(t *testing.T) {
+	bm := NewBitmap()
+	for _, x := range []uint64{0, 1, 1 << 16, 1<<16 + 2} {
+		bm.Set(x)
+	}
+	// Empty containers in between are skipped.
+	bm.Set(5 << 16)
+	bm.Remove(5 << 16)
+	bm.Set(6 << 16)
+
+	it := bm.NewIterator()
+	var got []uint64
+	for it.HasNext() {
+		// HasNext doesn't move the iterator.
+		require.True(t, it.HasNext())
+		got = append(got, it.Next())
+	}
+	require.Equal(t, []uint64{0, 1, 1 << 16, 1<<16 + 2, 6 << 16}, got)
+	require.False(t, it.HasNext())
+	require.Equal(t, uint64(0), it.Next())
+
+	require.False(t, NewBitmap().NewIterator().HasNext())
+
+	// A bitmap holding only 0.
+	bm = NewBitmap()
+	bm.Set(0)
+	it = bm.NewIterator()
+	require.True(t, it.HasNext())
+	require.Equal(t, uint64(0), it.Next())
+	require.False(t, it.HasNext())
+}
+
+func TestIteratorSeek(t *testing.T) {
+	bm, _ := randomBitmap(16)
+	bm.SetRange(20<<16+100, 20<<16+5000)
+	bm.SetRange(20<<16+6000, 20<<16+6001)
+	bm.Set(0)
+	arr := bm.ToArray()
+
+	// check seeks to x, and compares the next few elements with arr.
+	check := func(it *Iterator, arr []uint64, x uint64) {
+		it.Seek(x)
+		i := sort.Search(len(arr), func(i int) bool { return arr[i] >= x })
+		for j := i; j < i+40 && j < len(arr); j++ {
+			require.True(t, it.HasNext())
+			require.Equal(t, arr[j], it.Next(), "seek: %#x", x)
+		}
+		if i+40 >= len(arr) {
+			require.False(t, it.HasNext())
+		}
+	}
+
+	it := bm.NewIterator()
+	for i := 0; i < 10000; i++ {
+		var x uint64
+		switch rand.Intn(3) {
+		case 0:
+			x = uint64(rand.Intn(21 << 16))
+		case 1:
+			// An element of the bitmap, or next to one.
+			x = arr[rand.Intn(len(arr))] + uint64(rand.Intn(3)) - 1
+		case 2:
+			// The start of a container.
+			x = uint64(rand.Intn(21)) << 16
+		}
+		check(it, arr, x)
+	}
+	check(it, arr, 0)
+	check(it, arr, 20<<16+6000)
+	check(it, arr, 20<<16+6001)
+	check(it, arr, 1<<40)
+	require.False(t, it.HasNext())
+	require.Equal(t, uint64(0), it.Next())
+
+	// Seek around the first element of each 64-bit word of a bitmap container.
+	dense := NewBitmap()
+	for x := uint64(1); x < 1<<16; x += 3 {
+		dense.Set(x)
+	}
+	require.Equal(t, typeBitmap, dense.getContainer(dense.keys.val(0))[indexType])
+	denseArr := dense.ToArray()
+	it = dense.NewIterator()
+	for x := uint64(64); x < 1<<16; x += 64 {
+		check(it, denseArr, x-1)
+		check(it, denseArr, x)
+		check(it, denseArr, x+1)
+	}
+
+	// Seek within range iterators.
+	iters := bm.NewRangeIterators(4)
+	for _, it := range iters {
+		var part []uint64
+		for it.HasNext() {
+			part = append(part, it.Next())
+		}
+		require.NotEmpty(t, part)
+		for i := 0; i < 1000; i++ {
+			x := uint64(rand.Intn(21 << 16))
+			check(it, part, x)
+		}
+		check(it, part, 0)
+	}
+
+	// Seeking in an empty bitmap.
+	it = NewBitmap().NewIterator()
+	it.Seek(10)
+	require.False(t, it.HasNext())
+}
+
+func TestIteratorRange(t *testing.T) {
+	bm, _ := randomBitmap(16)
+	bm.SetRange(20<<16+100, 20<<16+5000)
+	bm.Set(0)
+	bm.Set(25 << 16)
+	bm.Remove(25 << 16)
+	arr := bm.ToArray()
+
+	check := func(lo, hi uint64) {
+		i := sort.Search(len(arr), func(i int) bool { return arr[i] >= lo })
+		j := sort.Search(len(arr), func(i int) bool { return arr[i] >= hi })
+		if j < i {
+			j = i
+		}
+		exp := arr[i:j]
+
+		it := bm.NewIteratorRange(lo, hi)
+		got := []uint64{}
+		for it.HasNext() {
+			got = append(got, it.Next())
+		}
+		require.Equal(t, exp, got, "range: [%#x, %#x)", lo, hi)
+		require.Equal(t, exp, bm.ToArrayRange(lo, hi), "range: [%#x, %#x)", lo, hi)
+
+		// Seeking stays within the range.
+		if len(exp) > 0 {
+			it.Seek(0)
+			require.Equal(t, exp[0], it.Next())
+			it.Seek(exp[len(exp)-1])
+			require.Equal(t, exp[len(exp)-1], it.Next())
+			require.False(t, it.HasNext())
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		var lo, hi uint64
+		switch rand.Intn(3) {
+		case 0:
+			lo = uint64(rand.Intn(22 << 16))
+			hi = lo + uint64(rand.Intn(3<<16))
+		case 1:
+			lo = arr[rand.Intn(len(arr))]
+			hi = arr[rand.Intn(len(arr))] + uint64(rand.Intn(2))
+		case 2:
+			// Container boundaries.
+			lo = uint64(rand.Intn(22)) << 16
+			hi = uint64(rand.Intn(22)) << 16
+		}
+		check(lo, hi)
+	}
+	check(0, 1)
+	check(0, 1<<40)
+	check(20<<16+100, 20<<16+5000)
+	check(20<<16+4999, 20<<16+5000)
+	check(10, 10)
+	check(10, 5)
+	require.Empty(t, NewBitmap().ToArrayRange(0, 1<<40))
+}
+
+func TestBalancedIterators(t *testing.T) {
+	collect := func(iters []*Iterator) [][]uint64 {
+		var parts [][]uint64
+		for _, it := range iters {
+			part := []uint64{}
+			for it.HasNext() {
+				part = append(part, it.Next())
+			}
+			parts = append(parts, part)
+		}
+		return parts
+	}
+	check := func(bm *Bitmap, n int) {
+		arr := bm.ToArray()
+		parts := collect(bm.NewBalancedIterators(n))
+		require.Len(t, parts, n)
+
+		all := []uint64{}
+		for _, part := range parts {
+			all = append(all, part...)
+			// Each iterator gets about the same number of elements.
+			require.InDelta(t, len(arr)/n, len(part), 1)
+		}
+		require.Equal(t, len(arr), len(all))
+		if len(arr) > 0 {
+			require.Equal(t, arr, all)
+		}
+	}
+
+	// A dense bitmap container, followed by a few sparse array containers.
+	bm := NewBitmap()
+	for x := uint64(0); x < 1<<16; x += 2 {
+		bm.Set(x)
+	}
+	for key := uint64(1); key < 8; key++ {
+		bm.Set(key<<16 + 7)
+	}
+	for _, n := range []int{1, 2, 3, 4, 7, 16} {
+		check(bm, n)
+	}
+
+	r, _ := randomBitmap(16)
+	r.Set(0)
+	r.Set(math.MaxUint64)
+	for _, n := range []int{1, 5, 8, 13} {
+		check(r, n)
+	}
+
+	// Fewer elements than iterators.
+	small := NewBitmap()
+	small.Set(0)
+	small.Set(5)
+	small.Set(1 << 20)
+	check(small, 5)
+	check(NewBitmap(), 3)
+}
+
+func TestReverseIterator(t *testing.T) {
+	bm, _ := randomBitmap(16)
+	bm.SetRange(20<<16+100, 20<<16+5000)
+	bm.SetRange(20<<16+6000, 20<<16+6001)
+	bm.Set(0)
+	bm.Set(30<<16 + 65535)
+	// An empty container in between.
+	bm.Set(25 << 16)
+	bm.Remove(25 << 16)
+	arr := bm.ToArray()
+
+	it := bm.NewReverseIterator()
+	for i := len(arr) - 1; i >= 0; i-- {
+		require.True(t, it.HasNext())
+		require.Equal(t, arr[i], it.Next())
+	}
+	require.False(t, it.HasNext())
+	require.Equal(t, uint64(0), it.Next())
+
+	// check seeks to x, and compares the next few elements with arr.
+	check := func(x uint64) {
+		it.Seek(x)
+		i := sort.Search(len(arr), func(i int) bool { return arr[i] > x }) - 1
+		for j := i; j > i-40 && j >= 0; j-- {
+			require.True(t, it.HasNext())
+			require.Equal(t, arr[j], it.Next(), "seek: %#x", x)
+		}
+		if i < 40 {
+			require.False(t, it.HasNext())
+		}
+	}
+	for i := 0; i < 10000; i++ {
+		var x uint64
+		switch rand.Intn(3) {
+		case 0:
+			x = uint64(rand.Intn(31 << 16))
+		case 1:
+			x = arr[rand.Intn(len(arr))] + uint64(rand.Intn(3)) - 1
+		case 2:
+			// The end of a container.
+			x = uint64(rand.Intn(31))<<16 | 0xFFFF
+		}
+		check(x)
+	}
+	check(0)
+	check(20<<16 + 6000)
+	check(20<<16 + 6001)
+	check(30<<16 + 65535)
+	check(1 << 40)
+
+	it = NewBitmap().NewReverseIterator()
+	require.False(t, it.HasNext())
+	it.Seek(1 << 20)
+	require.False(t, it.HasNext())
+}
+
 func TestManyIterator(t *testing.T) {
 	b := NewBitmap()
 	for i := 0; i < int(1e6); i++ {
@@ -126,6 +409,38 @@ func TestManyIterator(t *testing.T) {
 	}
 }
 
+func TestManyIteratorMixed(t *testing.T) {
+	bm, _ := randomBitmap(16)
+	bm.SetRange(20<<16+100, 20<<16+5000)
+	bm.Set(0)
+	bm.Set(25 << 16)
+	bm.Remove(25 << 16)
+	arr := bm.ToArray()
+
+	for _, sz := range []int{1, 7, 1000, 1 << 20} {
+		mi := bm.ManyIterator()
+		buf := make([]uint64, sz)
+		var got []uint64
+		for {
+			n := mi.NextMany(buf)
+			if n == 0 {
+				break
+			}
+			got = append(got, buf[:n]...)
+		}
+		require.Equal(t, arr, got)
+	}
+
+	mi := bm.ManyIterator()
+	buf := make([]uint64, 100)
+	allocs := testing.AllocsPerRun(100, func() {
+		mi.NextMany(buf)
+	})
+	require.Zero(t, allocs)
+
+	require.Zero(t, NewBitmap().ManyIterator().NextMany(buf))
+}
+
 func BenchmarkIterator(b *testing.B) {
 	bm := NewBitmap()
 	for i := 0; i < int(1e5); i++ {
@@ -135,7 +450,39 @@ func BenchmarkIterator(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		it := bm.NewIterator()
-		for it.Next() > 0 {
+		for it.HasNext() {
+			it.Next()
+		}
+	}
+}
+
+func BenchmarkReverseIterator(b *testing.B) {
+	bm := NewBitmap()
+	for i := 0; i < int(1e5); i++ {
+		bm.Set(uint64(i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := bm.NewReverseIterator()
+		for it.HasNext() {
+			it.Next()
+		}
+	}
+}
+
+func BenchmarkManyIterator(b *testing.B) {
+	bm := NewBitmap()
+	for i := 0; i < int(1e5); i++ {
+		bm.Set(uint64(i))
+	}
+	buf := make([]uint64, 1000)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		mi := bm.ManyIterator()
+		for mi.NextMany(buf) > 0 {
 		}
 	}
 }
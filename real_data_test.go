@@ -156,6 +156,12 @@ func BenchmarkRealDataFastAnd(b *testing.B) {
 	})
 }
 
+func BenchmarkRealDataFastParAnd(b *testing.B) {
+	benchmarkRealDataAggregate(b, func(bitmaps []*Bitmap) int {
+		return FastParAnd(4, bitmaps...).GetCardinality()
+	})
+}
+
 func TestOrRealData(t *testing.T) {
 	test := func(t *testing.T, dataset string) {
 		path, err := getDataSetPath(dataset)
@@ -0,0 +1,397 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// This file implements the portable serialization format of Roaring bitmaps, as documented in
+// https://github.com/RoaringBitmap/RoaringFormatSpec. It allows exchanging bitmaps with the other
+// Roaring implementations. The 32-bit format covers the elements below 2^32. The 64-bit format
+// groups the containers by the high 32 bits of their elements into buckets, and writes each bucket
+// as a 32-bit bitmap, prefixed by those high 32 bits.
+//
+// The sroar containers map directly to the portable ones. The only difference is that the
+// portable format expects an array container for up to 4096 elements, and a bitmap container
+// otherwise, unless it's a run container.
+
+const (
+	serialCookieNoRun = 12346 // Only array and bitmap containers.
+	serialCookie      = 12347 // Run containers too.
+
+	// Offsets of the containers are left out for bitmaps with run containers and fewer containers.
+	noOffsetThreshold = 4
+
+	// Size of a portable bitmap container in bytes.
+	portableBitmapSize = 8192
+)
+
+// ErrRoaringFormat is returned by ReadRoaring32 and ReadRoaring64 when the input isn't a valid
+// Roaring bitmap.
+var ErrRoaringFormat = errors.New("invalid roaring format")
+
+// WriteRoaring32 writes the bitmap to w in the 32-bit portable Roaring format. It fails if the
+// bitmap has elements which don't fit in 32 bits.
+func (ra *Bitmap) WriteRoaring32(w io.Writer) error {
+	if max := ra.Maximum(); max > math.MaxUint32 {
+		return errors.Errorf("element %d doesn't fit in 32 bits", max)
+	}
+	var idxs []int
+	for i := 0; i < ra.keys.numKeys(); i++ {
+		if getCardinality(ra.getContainer(ra.keys.val(i))) > 0 {
+			idxs = append(idxs, i)
+		}
+	}
+	return ra.writeRoaring(w, idxs)
+}
+
+// WriteRoaring64 writes the bitmap to w in the 64-bit portable Roaring format.
+func (ra *Bitmap) WriteRoaring64(w io.Writer) error {
+	// Group the non-empty containers by the high 32 bits of their keys.
+	var buckets [][]int
+	var highs []uint64
+	for i := 0; i < ra.keys.numKeys(); i++ {
+		if getCardinality(ra.getContainer(ra.keys.val(i))) == 0 {
+			continue
+		}
+		high := ra.keys.key(i) >> 32
+		if len(highs) == 0 || highs[len(highs)-1] != high {
+			highs = append(highs, high)
+			buckets = append(buckets, nil)
+		}
+		buckets[len(buckets)-1] = append(buckets[len(buckets)-1], i)
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(buckets)))
+	if _, err := w.Write(buf[:]); err != nil {
+		return errors.Wrap(err, "while writing the number of buckets")
+	}
+	for i, idxs := range buckets {
+		binary.LittleEndian.PutUint32(buf[:4], uint32(highs[i]))
+		if _, err := w.Write(buf[:4]); err != nil {
+			return errors.Wrap(err, "while writing the bucket key")
+		}
+		if err := ra.writeRoaring(w, idxs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRoaring writes the containers at the given indices as a 32-bit portable Roaring bitmap. The
+// containers must not be empty, and their keys must share the same high 32 bits.
+func (ra *Bitmap) writeRoaring(w io.Writer, idxs []int) error {
+	n := len(idxs)
+	containers := make([][]uint16, n)
+	hasRun := false
+	for i, idx := range idxs {
+		containers[i] = ra.getContainer(ra.keys.val(idx))
+		hasRun = hasRun || containers[i][indexType] == typeRun
+	}
+
+	var header []byte
+	if hasRun {
+		header = appendUint32(header, uint32(serialCookie|(n-1)<<16))
+		runs := make([]byte, (n+7)/8)
+		for i, c := range containers {
+			if c[indexType] == typeRun {
+				runs[i/8] |= 1 << (i % 8)
+			}
+		}
+		header = append(header, runs...)
+	} else {
+		header = appendUint32(header, serialCookieNoRun)
+		header = appendUint32(header, uint32(n))
+	}
+	for i, c := range containers {
+		header = appendUint16(header, uint16(ra.keys.key(idxs[i])>>16))
+		header = appendUint16(header, uint16(getCardinality(c)-1))
+	}
+	if !hasRun || n >= noOffsetThreshold {
+		offset := len(header) + 4*n
+		for _, c := range containers {
+			header = appendUint32(header, uint32(offset))
+			offset += portableSize(c)
+		}
+	}
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "while writing the header")
+	}
+
+	var buf []byte
+	for _, c := range containers {
+		buf = appendPortable(buf[:0], c)
+		if _, err := w.Write(buf); err != nil {
+			return errors.Wrap(err, "while writing a container")
+		}
+	}
+	return nil
+}
+
+// portableSize returns the size in bytes of the container in the portable format.
+func portableSize(c []uint16) int {
+	card := getCardinality(c)
+	switch {
+	case c[indexType] == typeRun:
+		return 2 + 4*run(c).numRuns()
+	case card <= 4096:
+		return 2 * card
+	default:
+		return portableBitmapSize
+	}
+}
+
+// appendPortable appends the container in the portable format to buf.
+func appendPortable(buf []byte, c []uint16) []byte {
+	switch c[indexType] {
+	case typeRun:
+		r := run(c)
+		buf = appendUint16(buf, uint16(r.numRuns()))
+		for i := 0; i < r.numRuns(); i++ {
+			// The portable format stores the length of the run minus one.
+			buf = appendUint16(buf, r.start(i))
+			buf = appendUint16(buf, r.last(i)-r.start(i))
+		}
+	case typeArray:
+		for _, x := range array(c).all() {
+			buf = appendUint16(buf, x)
+		}
+	case typeBitmap:
+		data := c[startIdx:]
+		if getCardinality(c) <= 4096 {
+			// Too few elements for a portable bitmap container. Write them as an array.
+			for idx, w := range data {
+				for w > 0 {
+					pos := bits.LeadingZeros16(w)
+					buf = appendUint16(buf, uint16(idx<<4|pos))
+					w &^= bitmapMask[pos]
+				}
+			}
+			break
+		}
+		// The portable bitmap is made of little-endian uint64s, where the least significant bit
+		// comes first. sroar uses uint16s, where the most significant bit comes first.
+		for i := 0; i < len(data); i += 4 {
+			var v uint64
+			for j := 0; j < 4; j++ {
+				v |= uint64(bits.Reverse16(data[i+j])) << (16 * j)
+			}
+			buf = appendUint64(buf, v)
+		}
+	}
+	return buf
+}
+
+// ReadRoaring32 reads a bitmap in the 32-bit portable Roaring format from r.
+func ReadRoaring32(r io.Reader) (*Bitmap, error) {
+	res := NewBitmap()
+	if err := res.readRoaring(r, 0); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReadRoaring64 reads a bitmap in the 64-bit portable Roaring format from r.
+func ReadRoaring64(r io.Reader) (*Bitmap, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, errors.Wrap(err, "while reading the number of buckets")
+	}
+	num := binary.LittleEndian.Uint64(buf[:])
+
+	res := NewBitmap()
+	var prev uint64
+	for i := uint64(0); i < num; i++ {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return nil, errors.Wrap(err, "while reading the bucket key")
+		}
+		high := uint64(binary.LittleEndian.Uint32(buf[:4]))
+		if i > 0 && high <= prev {
+			return nil, errors.Wrapf(ErrRoaringFormat, "bucket %d isn't sorted", high)
+		}
+		if err := res.readRoaring(r, high<<32); err != nil {
+			return nil, errors.Wrapf(err, "while reading bucket %d", high)
+		}
+		prev = high
+	}
+	return res, nil
+}
+
+// readRoaring reads a 32-bit portable Roaring bitmap from r, and adds its containers to the bitmap,
+// with high added to their keys.
+func (ra *Bitmap) readRoaring(r io.Reader, high uint64) error {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return errors.Wrap(err, "while reading the cookie")
+	}
+	cookie := binary.LittleEndian.Uint32(buf[:])
+
+	var n int
+	var runs []byte
+	switch {
+	case cookie&0xFFFF == serialCookie:
+		n = int(cookie>>16) + 1
+		runs = make([]byte, (n+7)/8)
+		if _, err := io.ReadFull(r, runs); err != nil {
+			return errors.Wrap(err, "while reading the run bitset")
+		}
+	case cookie == serialCookieNoRun:
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return errors.Wrap(err, "while reading the number of containers")
+		}
+		n = int(binary.LittleEndian.Uint32(buf[:]))
+	default:
+		return errors.Wrapf(ErrRoaringFormat, "unknown cookie: %#x", cookie)
+	}
+	if n > 1<<16 {
+		return errors.Wrapf(ErrRoaringFormat, "too many containers: %d", n)
+	}
+
+	desc := make([]byte, 4*n)
+	if _, err := io.ReadFull(r, desc); err != nil {
+		return errors.Wrap(err, "while reading the container keys")
+	}
+	if runs == nil || n >= noOffsetThreshold {
+		// The containers follow each other. So, the offsets aren't needed.
+		if _, err := io.CopyN(io.Discard, r, int64(4*n)); err != nil {
+			return errors.Wrap(err, "while reading the container offsets")
+		}
+	}
+
+	raw := make([]byte, portableBitmapSize)
+	var prev uint64
+	for i := 0; i < n; i++ {
+		key := high | uint64(binary.LittleEndian.Uint16(desc[4*i:]))<<16
+		card := int(binary.LittleEndian.Uint16(desc[4*i+2:])) + 1
+		if i > 0 && key <= prev {
+			return errors.Wrapf(ErrRoaringFormat, "container key %#x isn't sorted", key)
+		}
+		isRun := runs != nil && runs[i/8]&(1<<(i%8)) > 0
+
+		c, err := readPortable(r, card, isRun, raw)
+		if err != nil {
+			return errors.Wrapf(err, "container for key %#x", key)
+		}
+		if key == 0 {
+			// Every bitmap has a container for key 0. Reuse it, instead of orphaning it.
+			ra.copyAt(ra.keys.val(0), c)
+		} else {
+			offset := ra.newContainer(uint16(len(c)))
+			copy(ra.getContainer(offset), c)
+			ra.setKey(key, offset)
+		}
+		prev = key
+	}
+	return nil
+}
+
+// readPortable reads a container in the portable format from r, and returns it as an sroar
+// container. raw is used as scratch space to read the container.
+func readPortable(r io.Reader, card int, isRun bool, raw []byte) ([]uint16, error) {
+	switch {
+	case isRun:
+		if _, err := io.ReadFull(r, raw[:2]); err != nil {
+			return nil, errors.Wrap(err, "while reading the number of runs")
+		}
+		n := int(binary.LittleEndian.Uint16(raw))
+		if n > card {
+			return nil, errors.Wrapf(ErrRoaringFormat, "%d runs for cardinality: %d", n, card)
+		}
+		if 4*n > len(raw) {
+			raw = make([]byte, 4*n)
+		}
+		if _, err := io.ReadFull(r, raw[:4*n]); err != nil {
+			return nil, errors.Wrap(err, "while reading the runs")
+		}
+		buf := make([]uint16, runSize(n))
+		out := buf[runOffset(0):]
+		var num int
+		for i := 0; i < n; i++ {
+			start := binary.LittleEndian.Uint16(raw[4*i:])
+			length := binary.LittleEndian.Uint16(raw[4*i+2:])
+			if uint32(start)+uint32(length) > math.MaxUint16 ||
+				(i > 0 && uint32(start) <= uint32(out[2*i-1])+1) {
+				return nil, errors.Wrapf(ErrRoaringFormat, "invalid run at %d", i)
+			}
+			out[2*i], out[2*i+1] = start, start+length
+			num += int(length) + 1
+		}
+		if num != card {
+			return nil, errors.Wrapf(ErrRoaringFormat, "runs have %d elements, cardinality: %d",
+				num, card)
+		}
+		return runContainer(buf, n), nil
+
+	case card <= 4096:
+		if _, err := io.ReadFull(r, raw[:2*card]); err != nil {
+			return nil, errors.Wrap(err, "while reading the array")
+		}
+		// Leave a spare slot at the end, like the other array containers.
+		c := make([]uint16, int(startIdx)+card+1)
+		c[indexSize] = uint16(len(c))
+		c[indexType] = typeArray
+		setCardinality(c, card)
+		data := c[startIdx:]
+		for i := 0; i < card; i++ {
+			data[i] = binary.LittleEndian.Uint16(raw[2*i:])
+			if i > 0 && data[i] <= data[i-1] {
+				return nil, errors.Wrapf(ErrRoaringFormat, "array isn't sorted at %d", i)
+			}
+		}
+		return c, nil
+
+	default:
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, errors.Wrap(err, "while reading the bitmap")
+		}
+		c := make([]uint16, maxContainerSize)
+		c[indexSize] = maxContainerSize
+		c[indexType] = typeBitmap
+		data := c[startIdx:]
+		for i := 0; i < len(data); i += 4 {
+			v := binary.LittleEndian.Uint64(raw[2*i:])
+			for j := 0; j < 4; j++ {
+				data[i+j] = bits.Reverse16(uint16(v >> (16 * j)))
+			}
+		}
+		if num := bitmap(c).cardinality(); num != card {
+			return nil, errors.Wrapf(ErrRoaringFormat, "bitmap has %d elements, cardinality: %d",
+				num, card)
+		}
+		setCardinality(c, card)
+		return c, nil
+	}
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v)), uint32(v>>32))
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// portableBitmap returns a bitmap with all kinds of containers, under the given high 32 bits.
+func portableBitmap(high uint64) *Bitmap {
+	a := NewBitmap()
+	base := high << 32
+	// Array.
+	for x := uint64(0); x < 100; x++ {
+		a.Set(base + 1<<16 + 7*x)
+	}
+	// Bitmap.
+	for x := uint64(0); x < 10000; x++ {
+		a.Set(base + 2<<16 + 3*x)
+	}
+	// Bitmap with few elements, which is written as an array.
+	for x := uint64(0); x < 5000; x++ {
+		a.Set(base + 3<<16 + x*13)
+	}
+	for x := uint64(0); x < 3000; x++ {
+		a.Remove(base + 3<<16 + x*13)
+	}
+	// Runs.
+	a.SetRange(base+4<<16+10, base+4<<16+1000)
+	a.SetRange(base+4<<16+2000, base+6<<16+5)
+	a.Set(base + 65535)
+	return a
+}
+
+func TestRoaring32(t *testing.T) {
+	a := portableBitmap(0)
+	var buf bytes.Buffer
+	require.NoError(t, a.WriteRoaring32(&buf))
+
+	rb := roaring.New()
+	_, err := rb.ReadFrom(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	exp := a.ToArray()
+	got := rb.ToArray()
+	require.Equal(t, len(exp), len(got))
+	for i := range exp {
+		require.Equal(t, exp[i], uint64(got[i]))
+	}
+
+	b, err := ReadRoaring32(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.True(t, Equals(a, b))
+	// The container for key 0 is reused, so nothing is left orphaned.
+	require.Zero(t, b.Stats().OrphanedBytes)
+
+	// Read back what roaring writes, with and without run containers.
+	for _, optimize := range []bool{false, true} {
+		if optimize {
+			rb.RunOptimize()
+		}
+		buf.Reset()
+		_, err = rb.WriteTo(&buf)
+		require.NoError(t, err)
+		b, err = ReadRoaring32(&buf)
+		require.NoError(t, err)
+		require.True(t, Equals(a, b))
+	}
+
+	// Elements which don't fit in 32 bits.
+	a.Set(1 << 32)
+	require.Error(t, a.WriteRoaring32(&buf))
+
+	// Empty bitmaps.
+	buf.Reset()
+	require.NoError(t, NewBitmap().WriteRoaring32(&buf))
+	b, err = ReadRoaring32(&buf)
+	require.NoError(t, err)
+	require.True(t, b.IsEmpty())
+}
+
+func TestRoaring64(t *testing.T) {
+	a := portableBitmap(0)
+	a.Or(portableBitmap(1))
+	a.Or(portableBitmap(1 << 20))
+	a.Set(1<<63 + 5)
+
+	var buf bytes.Buffer
+	require.NoError(t, a.WriteRoaring64(&buf))
+
+	rb := roaring64.New()
+	_, err := rb.ReadFrom(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, a.ToArray(), rb.ToArray())
+
+	b, err := ReadRoaring64(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.True(t, Equals(a, b))
+	// The container for key 0 is reused, so nothing is left orphaned.
+	require.Zero(t, b.Stats().OrphanedBytes)
+
+	for _, optimize := range []bool{false, true} {
+		if optimize {
+			rb.RunOptimize()
+		}
+		buf.Reset()
+		_, err = rb.WriteTo(&buf)
+		require.NoError(t, err)
+		b, err = ReadRoaring64(&buf)
+		require.NoError(t, err)
+		require.True(t, Equals(a, b))
+	}
+
+	// Random bitmaps.
+	for i := 0; i < 5; i++ {
+		rb := roaring64.New()
+		for j := 0; j < 10000; j++ {
+			x := rand.Uint64() % (1 << 34)
+			rb.AddRange(x, x+uint64(rand.Intn(100)))
+		}
+		rb.RunOptimize()
+		buf.Reset()
+		_, err = rb.WriteTo(&buf)
+		require.NoError(t, err)
+		b, err := ReadRoaring64(&buf)
+		require.NoError(t, err)
+		require.Equal(t, rb.ToArray(), b.ToArray())
+
+		buf.Reset()
+		require.NoError(t, b.WriteRoaring64(&buf))
+		rb2 := roaring64.New()
+		_, err = rb2.ReadFrom(&buf)
+		require.NoError(t, err)
+		require.True(t, rb.Equals(rb2))
+	}
+}
+
+func TestRoaringErrors(t *testing.T) {
+	a := portableBitmap(0)
+	var buf bytes.Buffer
+	require.NoError(t, a.WriteRoaring32(&buf))
+	data := buf.Bytes()
+
+	// Truncated input.
+	for _, n := range []int{0, 3, 10, len(data) / 2, len(data) - 1} {
+		_, err := ReadRoaring32(bytes.NewReader(data[:n]))
+		require.Error(t, err)
+	}
+
+	corrupt := make([]byte, len(data))
+	copy(corrupt, data)
+	corrupt[0] ^= 0xFF
+	_, err := ReadRoaring32(bytes.NewReader(corrupt))
+	require.True(t, errors.Is(err, ErrRoaringFormat), "got: %v", err)
+
+	// Randomly corrupted input should never panic.
+	for i := 0; i < 1000; i++ {
+		copy(corrupt, data)
+		for j := 0; j < 1+rand.Intn(4); j++ {
+			corrupt[rand.Intn(len(corrupt))] = byte(rand.Intn(256))
+		}
+		if b, err := ReadRoaring32(bytes.NewReader(corrupt)); err == nil {
+			require.Equal(t, b.GetCardinality(), len(b.ToArray()))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build go1.23
+
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"iter"
+)
+
+// All returns an iterator over the elements of the bitmap, in ascending order.
+//
+//	for x := range bm.All() {
+//		...
+//	}
+func (ra *Bitmap) All() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		if ra != nil {
+			ascend(ra.NewIterator(), yield)
+		}
+	}
+}
+
+// AllRange returns an iterator over the elements of the bitmap in [lo, hi), in ascending order.
+func (ra *Bitmap) AllRange(lo, hi uint64) iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		if ra != nil {
+			ascend(ra.NewIteratorRange(lo, hi), yield)
+		}
+	}
+}
+
+// Backward returns an iterator over the elements of the bitmap, in descending order.
+func (ra *Bitmap) Backward() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		if ra == nil {
+			return
+		}
+		it := ra.NewReverseIterator()
+		for it.HasNext() {
+			if !yield(it.Next()) {
+				return
+			}
+		}
+	}
+}
+
+// Containers returns an iterator over the non-empty containers of the bitmap, in ascending order.
+// It yields the smallest value each container can hold, along with the number of elements in it.
+func (ra *Bitmap) Containers() iter.Seq2[uint64, int] {
+	return func(yield func(uint64, int) bool) {
+		if ra == nil {
+			return
+		}
+		for i := 0; i < ra.keys.numKeys(); i++ {
+			card := getCardinality(ra.getContainer(ra.keys.val(i)))
+			if card > 0 && !yield(ra.keys.key(i), card) {
+				return
+			}
+		}
+	}
+}
+
+// ascend calls yield for the elements left in it, until yield returns false. The elements are
+// decoded in batches by ManyItr, which is faster than calling Next for each of them.
+func ascend(it *Iterator, yield func(uint64) bool) {
+	itr := ManyItr{it: it}
+	var buf [64]uint64
+	for {
+		n := itr.NextMany(buf[:])
+		if n == 0 {
+			return
+		}
+		for _, x := range buf[:n] {
+			if !yield(x) {
+				return
+			}
+		}
+	}
+}
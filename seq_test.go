@@ -0,0 +1,145 @@
+//go:build go1.23
+
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeq(t *testing.T) {
+	bm, _ := randomBitmap(16)
+	bm.SetRange(20<<16+100, 20<<16+5000)
+	bm.Set(0)
+	bm.Set(math.MaxUint64)
+	bm.Set(25 << 16)
+	bm.Remove(25 << 16)
+	arr := bm.ToArray()
+
+	got := []uint64{}
+	for x := range bm.All() {
+		got = append(got, x)
+	}
+	require.Equal(t, arr, got)
+
+	got = got[:0]
+	for x := range bm.Backward() {
+		got = append(got, x)
+	}
+	require.Equal(t, len(arr), len(got))
+	for i, x := range got {
+		require.Equal(t, arr[len(arr)-1-i], x)
+	}
+
+	for i := 0; i < 500; i++ {
+		lo := uint64(rand.Intn(22 << 16))
+		hi := lo + uint64(rand.Intn(3<<16))
+		if i%2 == 0 {
+			lo, hi = arr[rand.Intn(len(arr))], arr[rand.Intn(len(arr))]+1
+		}
+		got = got[:0]
+		for x := range bm.AllRange(lo, hi) {
+			got = append(got, x)
+		}
+		require.Equal(t, bm.ToArrayRange(lo, hi), got, "range: [%#x, %#x)", lo, hi)
+	}
+
+	// Breaking out of the loop stops the iteration.
+	var n int
+	for range bm.All() {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	require.Equal(t, 10, n)
+	n = 0
+	for range bm.Backward() {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	require.Equal(t, 10, n)
+
+	// Breaking out in the middle of a run container.
+	runs := NewBitmap()
+	runs.SetRange(100, 1000)
+	require.Equal(t, typeRun, runs.getContainer(runs.keys.val(0))[indexType])
+	got = got[:0]
+	for x := range runs.Backward() {
+		got = append(got, x)
+		if len(got) == 3 {
+			break
+		}
+	}
+	require.Equal(t, []uint64{999, 998, 997}, got)
+	got = got[:0]
+	for x := range runs.All() {
+		got = append(got, x)
+		if len(got) == 3 {
+			break
+		}
+	}
+	require.Equal(t, []uint64{100, 101, 102}, got)
+
+	var card int
+	for key, c := range bm.Containers() {
+		require.Zero(t, key&^mask)
+		require.Greater(t, c, 0)
+		card += c
+	}
+	require.Equal(t, bm.GetCardinality(), card)
+
+	for range (*Bitmap)(nil).All() {
+		t.Fatal("nil bitmap has no elements")
+	}
+	for range NewBitmap().Backward() {
+		t.Fatal("empty bitmap has no elements")
+	}
+
+	// Iterating doesn't allocate per element.
+	allocs := testing.AllocsPerRun(10, func() {
+		for x := range bm.All() {
+			_ = x
+		}
+		for x := range bm.Backward() {
+			_ = x
+		}
+	})
+	require.LessOrEqual(t, allocs, float64(4))
+}
+
+func BenchmarkSeq(b *testing.B) {
+	bm := NewBitmap()
+	for i := 0; i < int(1e5); i++ {
+		bm.Set(uint64(i))
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for x := range bm.All() {
+			_ = x
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+// ContainerStats hold the statistics of the containers of one type.
+type ContainerStats struct {
+	// Count is the number of containers.
+	Count int
+	// Bytes is the space taken up by the containers, including their unused space.
+	Bytes int
+	// Cardinality is the number of elements in the containers.
+	Cardinality int
+}
+
+// Stats describe the memory layout of a bitmap. All the sizes are in bytes.
+type Stats struct {
+	// Cardinality is the number of elements in the bitmap.
+	Cardinality int
+
+	// NumKeys is the number of keys, i.e. of containers, including the empty ones.
+	NumKeys int
+	// KeyCapacity is the number of keys the node of keys can hold, before it needs to grow.
+	KeyCapacity int
+	// NodeBytes is the space taken up by the node of keys.
+	NodeBytes int
+	// NodeUsedBytes is the space of the node of keys used by the keys, and its header.
+	NodeUsedBytes int
+
+	Arrays  ContainerStats
+	Bitmaps ContainerStats
+	Runs    ContainerStats
+
+	// TotalBytes is the size of the buffer of the bitmap.
+	TotalBytes int
+	// OrphanedBytes is the space of the buffer which isn't used by the node of keys, nor by any
+	// container. It's left behind by operations which replace containers, and is reclaimed by
+	// Compact.
+	OrphanedBytes int
+	// MemMoved is the amount of memory moved around within the buffer, to make space for keys and
+	// containers.
+	MemMoved int
+
+	// FillHistogram counts the containers by the fraction of their space they use, in steps of
+	// 10%. The containers using less than 10% of their space are counted at index 0, and the ones
+	// using at least 90% at index 9. Bitmap containers always use all their space.
+	FillHistogram [10]int
+}
+
+// ContainerBytes returns the space taken up by all the containers.
+func (s Stats) ContainerBytes() int {
+	return s.Arrays.Bytes + s.Bitmaps.Bytes + s.Runs.Bytes
+}
+
+// UsedBytes returns the space used by the keys and the containers. Along with OrphanedBytes, the
+// unused part of the node of keys accounts for the rest of TotalBytes.
+func (s Stats) UsedBytes() int {
+	return s.NodeUsedBytes + s.ContainerBytes()
+}
+
+// Stats returns the statistics of the memory layout of the bitmap.
+func (ra *Bitmap) Stats() Stats {
+	var s Stats
+	if ra == nil {
+		return s
+	}
+	s.NumKeys = ra.keys.numKeys()
+	s.KeyCapacity = ra.keys.maxKeys()
+	s.NodeBytes = 8 * len(ra.keys)
+	s.NodeUsedBytes = 8 * keyOffset(s.NumKeys)
+	s.TotalBytes = 2 * len(ra.data)
+	s.MemMoved = 2 * ra.memMoved
+
+	for i := 0; i < s.NumKeys; i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		card := getCardinality(c)
+		s.Cardinality += card
+
+		var cs *ContainerStats
+		used := len(c)
+		switch c[indexType] {
+		case typeArray:
+			cs = &s.Arrays
+			used = int(startIdx) + card
+		case typeBitmap:
+			cs = &s.Bitmaps
+		case typeRun:
+			cs = &s.Runs
+			used = runOffset(run(c).numRuns())
+		}
+		cs.Count++
+		cs.Bytes += 2 * len(c)
+		cs.Cardinality += card
+
+		bucket := 10 * used / len(c)
+		if bucket > 9 {
+			bucket = 9
+		}
+		s.FillHistogram[bucket]++
+	}
+	s.OrphanedBytes = s.TotalBytes - s.NodeBytes - s.ContainerBytes()
+	return s
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	a := NewBitmap()
+	for x := uint64(0); x < 100; x++ {
+		a.Set(1<<16 + 7*x)
+	}
+	for x := uint64(0); x < 10000; x++ {
+		a.Set(2<<16 + 3*x)
+	}
+	a.SetRange(3<<16+10, 3<<16+1000)
+
+	s := a.Stats()
+	require.Equal(t, a.GetCardinality(), s.Cardinality)
+	require.Equal(t, 4, s.NumKeys)
+	require.GreaterOrEqual(t, s.KeyCapacity, s.NumKeys)
+	require.Equal(t, 8*len(a.keys), s.NodeBytes)
+
+	// The empty container at key 0 is an array.
+	require.Equal(t, 2, s.Arrays.Count)
+	require.Equal(t, 100, s.Arrays.Cardinality)
+	require.Equal(t, 1, s.Bitmaps.Count)
+	require.Equal(t, 10000, s.Bitmaps.Cardinality)
+	require.Equal(t, 2*maxContainerSize, s.Bitmaps.Bytes)
+	require.Equal(t, 1, s.Runs.Count)
+	require.Equal(t, 990, s.Runs.Cardinality)
+
+	var hist int
+	for _, n := range s.FillHistogram {
+		hist += n
+	}
+	require.Equal(t, s.NumKeys, hist)
+	require.Equal(t, 1, s.FillHistogram[0])
+	require.GreaterOrEqual(t, s.FillHistogram[9], 1)
+
+	require.Equal(t, 2*len(a.data), s.TotalBytes)
+	require.Equal(t, s.TotalBytes, s.NodeBytes+s.ContainerBytes()+s.OrphanedBytes)
+
+	// Intersecting leaves the replaced containers behind, which Compact reclaims.
+	a.And(a.Clone())
+	require.Greater(t, a.Stats().OrphanedBytes, 0)
+	a.Compact()
+	s = a.Stats()
+	require.Equal(t, 0, s.OrphanedBytes)
+	require.Equal(t, s.NumKeys+1, s.KeyCapacity)
+	require.Equal(t, s.TotalBytes, s.UsedBytes()+s.NodeBytes-s.NodeUsedBytes)
+
+	require.Contains(t, a.String(), "Orphaned: 0.")
+	require.Equal(t, Stats{}, (*Bitmap)(nil).Stats())
+}
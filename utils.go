@@ -60,6 +60,13 @@ func addUint64(a, b uint64) uint64 {
 	return a + b
 }
 
+// hostLittleEndian is true if the host stores integers in the little-endian byte order. Tests
+// change it to simulate a big-endian host.
+var hostLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
 func toByteSlice(b []uint16) []byte {
 	// reference: https://go101.org/article/unsafe.html
 	var bs []byte
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by FromBufferChecked. The returned error wraps one of these with the details of
+// what is wrong, so they can be checked for via errors.Is.
+var (
+	ErrBufferLength    = errors.New("invalid buffer length")
+	ErrNodeSize        = errors.New("invalid node size")
+	ErrNumKeys         = errors.New("invalid number of keys")
+	ErrKeys            = errors.New("invalid keys")
+	ErrContainerOffset = errors.New("container offset out of bounds")
+	ErrContainerSize   = errors.New("invalid container size")
+	ErrContainerType   = errors.New("invalid container type")
+	ErrContainerData   = errors.New("invalid container data")
+	ErrCardinality     = errors.New("cardinality doesn't match the container")
+)
+
+// FromBufferChecked is like FromBuffer, but it first validates the given buffer. Instead of
+// panicking on a truncated or corrupted buffer, it returns an error describing what is wrong. For
+// buffers in the versioned layout, it also verifies the checksum, if present. Just like with
+// FromBuffer, the returned bitmap shouldn't be modified.
+func FromBufferChecked(data []byte) (*Bitmap, error) {
+	data, err := bitmapData(data, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return NewBitmap(), nil
+	}
+	if len(data)%2 != 0 || len(data) < 8*keyOffset(1) {
+		return nil, errors.Wrapf(ErrBufferLength, "length: %d", len(data))
+	}
+	du := fromCanonical(data, false)
+	if err := validate(du); err != nil {
+		return nil, err
+	}
+	return fromData(du, data), nil
+}
+
+// validate checks that data holds a valid bitmap, i.e. the node of keys followed by containers.
+func validate(data []uint16) error {
+	sz := toUint64Slice(data[:4])[indexNodeSize]
+	if sz%4 != 0 || sz < uint64(4*keyOffset(1)) || sz > uint64(len(data)) {
+		return errors.Wrapf(ErrNodeSize, "node size: %d, buffer size: %d", sz, len(data))
+	}
+
+	keys := node(toUint64Slice(data[:sz]))
+	if num := keys.uint64(indexNumKeys); num == 0 || num > uint64(keys.maxKeys()) {
+		return errors.Wrapf(ErrNumKeys, "num keys: %d, max keys: %d", num, keys.maxKeys())
+	}
+	offsets := make([]uint64, 0, keys.numKeys())
+	for i := 0; i < keys.numKeys(); i++ {
+		key := keys.key(i)
+		switch {
+		case key&^mask != 0:
+			return errors.Wrapf(ErrKeys, "key %#x at index %d isn't a container key", key, i)
+		case i == 0 && key != 0:
+			return errors.Wrapf(ErrKeys, "first key should be 0, found %#x", key)
+		case i > 0 && key <= keys.key(i-1):
+			return errors.Wrapf(ErrKeys, "key %#x at index %d isn't greater than the previous key",
+				key, i)
+		}
+
+		offset := keys.val(i)
+		if offset < sz || offset >= uint64(len(data))-uint64(startIdx) {
+			return errors.Wrapf(ErrContainerOffset, "offset %d of key %#x, buffer size: %d",
+				offset, key, len(data))
+		}
+		if err := validateContainer(data[offset:]); err != nil {
+			return errors.Wrapf(err, "container for key %#x at offset %d", key, offset)
+		}
+		offsets = append(offsets, offset)
+	}
+
+	// Containers must not overlap. Otherwise, modifying a clone of the bitmap would modify several
+	// containers at once.
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for i := 1; i < len(offsets); i++ {
+		if end := offsets[i-1] + uint64(data[offsets[i-1]]); end > offsets[i] {
+			return errors.Wrapf(ErrContainerOffset, "container at offset %d overlaps the one at %d",
+				offsets[i-1], offsets[i])
+		}
+	}
+	return nil
+}
+
+// validateContainer checks that the container at the start of data is well formed, and that its
+// cardinality matches its content.
+func validateContainer(data []uint16) error {
+	sz := int(data[indexSize])
+	if sz <= int(startIdx) || sz > maxContainerSize || sz > len(data) {
+		return errors.Wrapf(ErrContainerSize, "size: %d, remaining buffer: %d", sz, len(data))
+	}
+	c := data[:sz]
+	card := getCardinality(c)
+
+	switch c[indexType] {
+	case typeArray:
+		if card > sz-int(startIdx) {
+			return errors.Wrapf(ErrCardinality, "array of size %d can't hold %d elements", sz, card)
+		}
+		vals := array(c).all()
+		for i := 1; i < len(vals); i++ {
+			if vals[i] <= vals[i-1] {
+				return errors.Wrapf(ErrContainerData, "array elements aren't sorted at index %d", i)
+			}
+		}
+
+	case typeBitmap:
+		if sz != maxContainerSize {
+			return errors.Wrapf(ErrContainerSize, "bitmap of size: %d", sz)
+		}
+		if num := bitmap(c).cardinality(); num != card {
+			return errors.Wrapf(ErrCardinality, "bitmap has %d elements, cardinality: %d", num, card)
+		}
+
+	case typeRun:
+		r := run(c)
+		if runOffset(r.numRuns()) > sz {
+			return errors.Wrapf(ErrContainerSize, "run container of size %d can't hold %d runs",
+				sz, r.numRuns())
+		}
+		var num int
+		for i := 0; i < r.numRuns(); i++ {
+			// Runs must be sorted, and neither overlap nor be adjacent to the previous one, as
+			// adjacent runs would have been merged into one.
+			if r.start(i) > r.last(i) || (i > 0 && uint32(r.start(i)) <= uint32(r.last(i-1))+1) {
+				return errors.Wrapf(ErrContainerData, "run %d [%d, %d] is invalid",
+					i, r.start(i), r.last(i))
+			}
+			num += int(r.last(i)-r.start(i)) + 1
+		}
+		if num != card {
+			return errors.Wrapf(ErrCardinality, "runs have %d elements, cardinality: %d", num, card)
+		}
+
+	default:
+		return errors.Wrapf(ErrContainerType, "type: %d", c[indexType])
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromBufferChecked(t *testing.T) {
+	// A bitmap with an array, a bitmap and a run container.
+	arrayKey, bitmapKey, runKey := uint64(1<<16), uint64(2<<16), uint64(3<<16)
+	a := NewBitmap()
+	for x := uint64(0); x < 100; x++ {
+		a.Set(arrayKey + 7*x)
+	}
+	for x := uint64(0); x < 10000; x++ {
+		a.Set(bitmapKey + 3*x)
+	}
+	a.SetRange(runKey+10, runKey+1000)
+	a.SetRange(runKey+2000, runKey+3000)
+	buf := a.ToBufferWithCopy()
+
+	b, err := FromBufferChecked(buf)
+	require.NoError(t, err)
+	require.True(t, Equals(a, b))
+
+	b, err = FromBufferChecked(nil)
+	require.NoError(t, err)
+	require.True(t, b.IsEmpty())
+
+	// findKey returns the offset of the container for the given key, in uint16s.
+	findKey := func(data []uint16, key uint64) uint64 {
+		offset, has := node(toUint64Slice(data[:a.keys.size()])).getValue(key)
+		require.True(t, has)
+		return offset
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(data []uint16) []uint16
+		err     error
+	}{
+		{"odd length", func(data []uint16) []uint16 { return nil }, ErrBufferLength},
+		{"node size", func(data []uint16) []uint16 {
+			toUint64Slice(data)[indexNodeSize] = uint64(len(data) + 4)
+			return data
+		}, ErrNodeSize},
+		{"truncated", func(data []uint16) []uint16 { return data[:a.keys.size()-4] }, ErrNodeSize},
+		{"num keys", func(data []uint16) []uint16 {
+			toUint64Slice(data)[indexNumKeys] = 1 << 40
+			return data
+		}, ErrNumKeys},
+		{"unsorted keys", func(data []uint16) []uint16 {
+			n := node(toUint64Slice(data[:a.keys.size()]))
+			n.setAt(keyOffset(1), n.key(2))
+			return data
+		}, ErrKeys},
+		{"first key", func(data []uint16) []uint16 {
+			node(toUint64Slice(data)).setAt(keyOffset(0), 1<<16)
+			return data
+		}, ErrKeys},
+		{"not a container key", func(data []uint16) []uint16 {
+			node(toUint64Slice(data)).setAt(keyOffset(1), 1<<16+1)
+			return data
+		}, ErrKeys},
+		{"offset", func(data []uint16) []uint16 {
+			node(toUint64Slice(data)).setAt(valOffset(1), uint64(len(data)))
+			return data
+		}, ErrContainerOffset},
+		{"offset within node", func(data []uint16) []uint16 {
+			node(toUint64Slice(data)).setAt(valOffset(1), 8)
+			return data
+		}, ErrContainerOffset},
+		{"truncated container", func(data []uint16) []uint16 {
+			return data[:len(data)-2]
+		}, ErrContainerSize},
+		{"container type", func(data []uint16) []uint16 {
+			data[findKey(data, arrayKey)+uint64(indexType)] = 7
+			return data
+		}, ErrContainerType},
+		{"array cardinality", func(data []uint16) []uint16 {
+			setCardinality(data[findKey(data, arrayKey):], 5000)
+			return data
+		}, ErrCardinality},
+		{"unsorted array", func(data []uint16) []uint16 {
+			c := data[findKey(data, arrayKey):]
+			c[startIdx], c[startIdx+1] = c[startIdx+1], c[startIdx]
+			return data
+		}, ErrContainerData},
+		{"bitmap size", func(data []uint16) []uint16 {
+			data[findKey(data, bitmapKey)] = 100
+			return data
+		}, ErrContainerSize},
+		{"bitmap cardinality", func(data []uint16) []uint16 {
+			c := data[findKey(data, bitmapKey):]
+			c[startIdx+100] ^= 1
+			return data
+		}, ErrCardinality},
+		{"bitmap stored cardinality", func(data []uint16) []uint16 {
+			c := data[findKey(data, bitmapKey):]
+			setCardinality(c, getCardinality(c)+1)
+			return data
+		}, ErrCardinality},
+		{"run cardinality", func(data []uint16) []uint16 {
+			setCardinality(data[findKey(data, runKey):], 10)
+			return data
+		}, ErrCardinality},
+		{"num runs", func(data []uint16) []uint16 {
+			data[findKey(data, runKey)+uint64(startIdx)] = 1000
+			return data
+		}, ErrContainerSize},
+		{"invalid run", func(data []uint16) []uint16 {
+			run(data[findKey(data, runKey):]).setRun(0, 10, 5)
+			return data
+		}, ErrContainerData},
+		{"unsorted runs", func(data []uint16) []uint16 {
+			r := run(data[findKey(data, runKey):])
+			r.setRun(0, 2000, 2999)
+			r.setRun(1, 10, 999)
+			return data
+		}, ErrContainerData},
+		{"overlapping runs", func(data []uint16) []uint16 {
+			run(data[findKey(data, runKey):]).setRun(1, 900, 2999)
+			return data
+		}, ErrContainerData},
+		{"adjacent runs", func(data []uint16) []uint16 {
+			run(data[findKey(data, runKey):]).setRun(0, 10, 1999)
+			return data
+		}, ErrContainerData},
+		{"overlapping containers", func(data []uint16) []uint16 {
+			n := node(toUint64Slice(data[:a.keys.size()]))
+			n.setAt(valOffset(3), findKey(data, arrayKey))
+			return data
+		}, ErrContainerOffset},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := toUint16Slice(a.ToBufferWithCopy())
+			data = tc.corrupt(data)
+			var buf []byte
+			if data == nil {
+				buf = make([]byte, 101)
+			} else {
+				buf = toByteSlice(data)
+			}
+			_, err := FromBufferChecked(buf)
+			require.Error(t, err)
+			require.True(t, errors.Is(err, tc.err), "got: %v", err)
+		})
+	}
+
+	// Randomly corrupted buffers should either be rejected, or be safe to read.
+	for i := 0; i < 1000; i++ {
+		buf := a.ToBufferWithCopy()
+		for j := 0; j < 1+rand.Intn(4); j++ {
+			buf[rand.Intn(len(buf))] = byte(rand.Intn(256))
+		}
+		if rand.Intn(4) == 0 {
+			buf = buf[:2*rand.Intn(len(buf)/2)]
+		}
+		bm, err := FromBufferChecked(buf)
+		if err != nil {
+			continue
+		}
+		arr := bm.ToArray()
+		require.Equal(t, bm.GetCardinality(), len(arr))
+		for j, x := range arr {
+			val, err := bm.Select(uint64(j))
+			require.NoError(t, err)
+			require.Equal(t, x, val)
+			require.Equal(t, j, bm.Rank(x))
+		}
+		itr := bm.NewIterator()
+		for itr.HasNext() {
+			itr.Next()
+		}
+		ritr := bm.NewReverseIterator()
+		for ritr.HasNext() {
+			ritr.Next()
+		}
+
+		// A clone of the bitmap can be modified.
+		c := bm.Clone()
+		c.Set(runKey + 1500)
+		c.Remove(arrayKey)
+		c.Or(a)
+		require.True(t, Equals(a, And(a, c)))
+	}
+}